@@ -0,0 +1,38 @@
+package main
+
+import "math"
+
+// Axis aligned bounding box
+type AABB struct {
+	Min, Max Vector3
+}
+
+// Intersect the ray with the box using the slab method. Returns the distances along
+// the ray where it enters and leaves the box, tmin is negative if the ray starts
+// inside. hit is false if the ray misses or the box is entirely behind the ray.
+func (b AABB) Intersect(r Ray) (tmin, tmax float64, hit bool) {
+	tmin, tmax = math.Inf(-1), math.Inf(1)
+	o := [3]float64{r.Origin.X, r.Origin.Y, r.Origin.Z}
+	d := [3]float64{r.Direction.X, r.Direction.Y, r.Direction.Z}
+	lo := [3]float64{b.Min.X, b.Min.Y, b.Min.Z}
+	hi := [3]float64{b.Max.X, b.Max.Y, b.Max.Z}
+
+	for i := 0; i < 3; i++ {
+		if d[i] == 0 {
+			// Parallel to the slab, handled separately to avoid 0 * Inf = NaN
+			// when the origin lies on a face
+			if o[i] < lo[i] || o[i] > hi[i] {
+				return 0, 0, false
+			}
+			continue
+		}
+		t1 := (lo[i] - o[i]) / d[i]
+		t2 := (hi[i] - o[i]) / d[i]
+		if t1 > t2 {
+			t1, t2 = t2, t1
+		}
+		tmin = math.Max(tmin, t1)
+		tmax = math.Min(tmax, t2)
+	}
+	return tmin, tmax, tmax >= math.Max(tmin, 0)
+}
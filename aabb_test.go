@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAABBIntersect(t *testing.T) {
+	b := AABB{Vector3{-1, -1, -1}, Vector3{1, 1, 1}}
+
+	// Straight through along Z, parallel to the X and Y slabs
+	tmin, tmax, hit := b.Intersect(Ray{Vector3{0, 0, -5}, Vector3{0, 0, 1}})
+	if !hit || tmin != 4 || tmax != 6 {
+		t.Errorf("Expected hit from 4 to 6, got %v %v %v", tmin, tmax, hit)
+	}
+
+	// Diagonal through a corner region
+	d := Vector3{1, 1, 1}.Normalize()
+	tmin, tmax, hit = b.Intersect(Ray{d.Multiply(-10), d})
+	if !hit || !nearlyEqual(tmax-tmin, 2*math.Sqrt(3), 1e-12) {
+		t.Errorf("Expected diagonal hit, got %v %v %v", tmin, tmax, hit)
+	}
+
+	// Missing to the side
+	if _, _, hit := b.Intersect(Ray{Vector3{2, 0, -5}, Vector3{0, 0, 1}}); hit {
+		t.Errorf("Expected ray beside the box to miss")
+	}
+	// Box is behind the ray
+	if _, _, hit := b.Intersect(Ray{Vector3{0, 0, 5}, Vector3{0, 0, 1}}); hit {
+		t.Errorf("Expected box behind the ray to miss")
+	}
+
+	// Starting inside
+	tmin, tmax, hit = b.Intersect(Ray{Vector3{0, 0, 0}, Vector3{1, 0, 0}})
+	if !hit || tmin != -1 || tmax != 1 {
+		t.Errorf("Expected hit from -1 to 1, got %v %v %v", tmin, tmax, hit)
+	}
+
+	// Parallel ray with the origin on a face must not produce NaNs
+	tmin, tmax, hit = b.Intersect(Ray{Vector3{1, 0, -5}, Vector3{0, 0, 1}})
+	if !hit || math.IsNaN(tmin) || math.IsNaN(tmax) {
+		t.Errorf("Expected hit along the face, got %v %v %v", tmin, tmax, hit)
+	}
+}
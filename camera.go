@@ -0,0 +1,45 @@
+package main
+
+import "math"
+
+// Vertical field of view of the original fixed projection, which placed the image
+// plane 5 units in front of the camera with a half height of 1
+var DefaultFOVDegrees = 2 * math.Atan(1.0/5) * 180 / math.Pi
+
+// Perspective camera positioned in world space
+type Camera struct {
+	Position Vector3
+	LookAt   Vector3
+	Up       Vector3
+	// Vertical field of view
+	FOVDegrees float64
+}
+
+// Returns the orthonormal camera basis. forward points from the camera to the look at
+// point, right and up span the image plane with right increasing to the right of the
+// image and up increasing to the top.
+func (c Camera) basis() (forward, right, up Vector3) {
+	forward = c.LookAt.Sub(c.Position).Normalize()
+	right = c.Up.Cross(forward).Normalize()
+	up = forward.Cross(right)
+	return forward, right, up
+}
+
+// Ray from the camera through pixel x, y of a width x height image. Pixel 0, 0 is
+// the top left of the image.
+func (c Camera) RayFor(x, y, width, height int) Ray {
+	return c.RayThrough(float64(x), float64(y), width, height)
+}
+
+// Same as RayFor but through any point on the image plane given in fractional pixels
+func (c Camera) RayThrough(px, py float64, width, height int) Ray {
+	forward, right, up := c.basis()
+
+	tanHalf := math.Tan(c.FOVDegrees * math.Pi / 360)
+	aspect := float64(width) / float64(height)
+	sx := (px - float64(width/2)) / float64(width/2)
+	sy := (float64(height/2) - py) / float64(height/2)
+
+	dir := forward.Add(right.Multiply(sx * aspect * tanHalf)).Add(up.Multiply(sy * tanHalf))
+	return Ray{c.Position, dir.Normalize()}
+}
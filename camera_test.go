@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCameraRayFor(t *testing.T) {
+	c := Camera{
+		Position:   Vector3{1000, 2000, -5000},
+		LookAt:     Vector3{0, 0, 0},
+		Up:         Vector3{0, 1, 0},
+		FOVDegrees: 60,
+	}
+	const width, height = 640, 480
+	forward := c.LookAt.Sub(c.Position).Normalize()
+
+	r := c.RayFor(width/2, height/2, width, height)
+	if r.Origin != c.Position {
+		t.Errorf("Expected ray to start at the camera, got %v", r.Origin)
+	}
+	if d := r.Direction.Dot(forward); !nearlyEqual(d, 1, 1e-12) {
+		t.Errorf("Expected center ray to point at the look at target, got %v", r.Direction)
+	}
+
+	halfFOV := 30 * math.Pi / 180
+	angle := func(x, y int) float64 {
+		return math.Acos(c.RayFor(x, y, width, height).Direction.Dot(forward))
+	}
+	if a := angle(width/2, 0); !nearlyEqual(a, halfFOV, 1e-9) {
+		t.Errorf("Expected top edge ray at %v radians, got %v", halfFOV, a)
+	}
+	if a := angle(width/2, height); !nearlyEqual(a, halfFOV, 1e-9) {
+		t.Errorf("Expected bottom edge ray at %v radians, got %v", halfFOV, a)
+	}
+	halfHFOV := math.Atan(math.Tan(halfFOV) * width / height)
+	if a := angle(0, height/2); !nearlyEqual(a, halfHFOV, 1e-9) {
+		t.Errorf("Expected left edge ray at %v radians, got %v", halfHFOV, a)
+	}
+
+	// Top left corner opens up and to the left
+	_, right, up := c.basis()
+	corner := c.RayFor(0, 0, width, height).Direction
+	if corner.Dot(right) >= 0 || corner.Dot(up) <= 0 {
+		t.Errorf("Expected top left corner ray to point up and left, got %v", corner)
+	}
+}
+
+func TestCameraMatchesFixedProjection(t *testing.T) {
+	c := NewScene(nil).Camera
+	const width, height = 640, 480
+
+	for _, p := range [][2]int{{0, 0}, {320, 240}, {639, 479}, {100, 400}} {
+		x, y := p[0], p[1]
+		var dir Vector3
+		dir.X = (float64(x-width/2) / (width / 2)) * (float64(width) / height)
+		dir.Y = float64(height/2-y) / (height / 2)
+		dir.Z = 5
+		want := dir.Normalize()
+
+		got := c.RayFor(x, y, width, height).Direction
+		if !nearlyEqual(got.X, want.X, 1e-12) || !nearlyEqual(got.Y, want.Y, 1e-12) || !nearlyEqual(got.Z, want.Z, 1e-12) {
+			t.Errorf("Pixel %v, %v: expected %v got %v", x, y, want, got)
+		}
+	}
+}
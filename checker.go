@@ -0,0 +1,46 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// Texels along each side of a CheckerTexture square, enough that bilinear filtering
+// only blurs the edges of the squares
+const checkerSquareSize = 16
+
+// Procedural checkerboard for debugging the UV mapping without an image file. It is
+// an image so it can be used wherever a texture is, the squares alternate between
+// colors A and B, Columns squares across u and Rows down v.
+type CheckerTexture struct {
+	Columns, Rows int
+	A, B          color.Color
+}
+
+// Checkerboard of white and dark gray squares 15 degrees of longitude and latitude
+// across on the planet
+func NewCheckerTexture() CheckerTexture {
+	return CheckerTexture{
+		Columns: 24,
+		Rows:    12,
+		A:       color.NRGBA{255, 255, 255, 255},
+		B:       color.NRGBA{64, 64, 64, 255},
+	}
+}
+
+var _ image.Image = CheckerTexture{}
+
+func (c CheckerTexture) ColorModel() color.Model {
+	return color.NRGBAModel
+}
+
+func (c CheckerTexture) Bounds() image.Rectangle {
+	return image.Rect(0, 0, c.Columns*checkerSquareSize, c.Rows*checkerSquareSize)
+}
+
+func (c CheckerTexture) At(x, y int) color.Color {
+	if (x/checkerSquareSize+y/checkerSquareSize)%2 == 0 {
+		return c.A
+	}
+	return c.B
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestCheckerTexture(t *testing.T) {
+	c := NewCheckerTexture()
+	a := NewColorFromRGBA(c.A.RGBA())
+	b := NewColorFromRGBA(c.B.RGBA())
+
+	// Centers of two squares next to each other across u and then across v
+	du, dv := 1/float64(c.Columns), 1/float64(c.Rows)
+	u, v := 3.5*du, 5.5*dv
+	for _, f := range []TextureFilter{FilterNearest, FilterBilinear} {
+		first := f.Sample(c, u, v)
+		if first != a && first != b {
+			t.Fatalf("Filter %v: expected one of the two colors, got %v", f, first)
+		}
+		if got := f.Sample(c, u+du, v); got == first || (got != a && got != b) {
+			t.Errorf("Filter %v: expected the square across u to be the other color than %v, got %v", f, first, got)
+		}
+		if got := f.Sample(c, u, v+dv); got == first || (got != a && got != b) {
+			t.Errorf("Filter %v: expected the square across v to be the other color than %v, got %v", f, first, got)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+// Average every pixel of the w x h row major buffer fb with its neighbours within
+// radius pixels horizontally and vertically. Near the edges the window is clipped
+// to the image and the average is over the pixels inside it. Returns a new buffer.
+func boxBlur(fb []Color, w, h, radius int) []Color {
+	if radius <= 0 {
+		return append([]Color(nil), fb[:w*h]...)
+	}
+
+	// The clipped box is a rectangle, so blur the rows and then the columns
+	tmp := make([]Color, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			tmp[y*w+x] = boxAverage(fb, y*w, 1, x, w, radius)
+		}
+	}
+	out := make([]Color, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			out[y*w+x] = boxAverage(tmp, x, w, y, h, radius)
+		}
+	}
+	return out
+}
+
+// Average of the n pixels of a line starting at offset start and spaced stride
+// apart, over the window of radius around pixel i clipped to the line
+func boxAverage(fb []Color, start, stride, i, n, radius int) Color {
+	lo, hi := i-radius, i+radius
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > n-1 {
+		hi = n - 1
+	}
+	var sum Color
+	for j := lo; j <= hi; j++ {
+		c := fb[start+j*stride]
+		sum = Color{sum.R + c.R, sum.G + c.G, sum.B + c.B, sum.A + c.A}
+	}
+	k := float64(hi - lo + 1)
+	return Color{sum.R / k, sum.G / k, sum.B / k, sum.A / k}
+}
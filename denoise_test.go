@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestBoxBlurConstant(t *testing.T) {
+	w, h := 7, 5
+	c := Color{0.25, 0.5, 2, 1}
+	fb := make([]Color, w*h)
+	for i := range fb {
+		fb[i] = c
+	}
+	for _, radius := range []int{0, 1, 3, 10} {
+		for i, got := range boxBlur(fb, w, h, radius) {
+			if got != c {
+				t.Fatalf("radius %v: expected pixel %v to stay %v, got %v", radius, i, c, got)
+			}
+		}
+	}
+}
+
+func TestBoxBlurSpreads(t *testing.T) {
+	w, h := 5, 5
+	fb := make([]Color, w*h)
+	fb[2*w+2] = Color{9, 9, 9, 1}
+
+	out := boxBlur(fb, w, h, 1)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			got := out[y*w+x].R
+			want := 0.0
+			if x >= 1 && x <= 3 && y >= 1 && y <= 3 {
+				want = 1
+			}
+			if !nearlyEqual(got, want, 1e-12) {
+				t.Errorf("Pixel %v,%v: expected %v got %v", x, y, want, got)
+			}
+		}
+	}
+	if fb[2*w+2].R != 9 {
+		t.Errorf("Expected the input buffer to be left alone")
+	}
+
+	// At a corner the window holds only the 4 pixels inside the image
+	fb = make([]Color, w*h)
+	fb[0] = Color{4, 4, 4, 1}
+	if got := boxBlur(fb, w, h, 1)[0].R; got != 1 {
+		t.Errorf("Expected the corner average over 4 pixels to be 1, got %v", got)
+	}
+}
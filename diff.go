@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// Root mean square difference between two images over every channel, including
+// alpha, with channel values scaled to [0,1]. Returns an error if the bounds differ.
+func ImageRMSE(a, b *image.RGBA) (float64, error) {
+	if a.Bounds() != b.Bounds() {
+		return 0, fmt.Errorf("image bounds %v and %v differ", a.Bounds(), b.Bounds())
+	}
+	bounds := a.Bounds()
+	if bounds.Empty() {
+		return 0, nil
+	}
+
+	var sum float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		pa, pb := a.Pix[a.PixOffset(bounds.Min.X, y):], b.Pix[b.PixOffset(bounds.Min.X, y):]
+		for i := 0; i < 4*bounds.Dx(); i++ {
+			d := (float64(pa[i]) - float64(pb[i])) / 255
+			sum += d * d
+		}
+	}
+	return math.Sqrt(sum / float64(4*bounds.Dx()*bounds.Dy())), nil
+}
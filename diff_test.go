@@ -0,0 +1,32 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestImageRMSE(t *testing.T) {
+	a := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	b := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			a.Set(x, y, color.RGBA{10, 20, 30, 255})
+			b.Set(x, y, color.RGBA{10, 20, 30, 255})
+		}
+	}
+	if rmse, err := ImageRMSE(a, b); err != nil || rmse != 0 {
+		t.Errorf("Expected identical images to have an RMSE of 0, got %v %v", rmse, err)
+	}
+
+	// One channel of one pixel differs by the full range, 1 of 16 values
+	b.Set(1, 1, color.RGBA{10, 20, 255, 255})
+	a.Set(1, 1, color.RGBA{10, 20, 0, 255})
+	if rmse, err := ImageRMSE(a, b); err != nil || !nearlyEqual(rmse, 0.25, 1e-12) {
+		t.Errorf("Expected an RMSE of 0.25, got %v %v", rmse, err)
+	}
+
+	if _, err := ImageRMSE(a, image.NewRGBA(image.Rect(0, 0, 2, 3))); err == nil {
+		t.Errorf("Expected an error for mismatched bounds")
+	}
+}
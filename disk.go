@@ -0,0 +1,50 @@
+package main
+
+import "math"
+
+// Flat circular disk facing along N, e.g. a visible sun. Like Plane the normal field
+// is named N so it does not clash with the Normal method.
+type Disk struct {
+	Center    Vector3
+	N         Vector3
+	Radius    float64
+	Transform Matrix
+}
+
+var _ Shape = &Disk{}
+
+func (d Disk) Intersect(r Ray) Hit {
+	inv, ok := d.Transform.TryInverse()
+	if !ok {
+		return NoHit
+	}
+	or := inv.TransformRay(r)
+
+	n := d.N.Normalize()
+	dn := n.Dot(or.Direction)
+	if math.Abs(dn) < 1e-12 {
+		// Ray is parallel to the disk
+		return NoHit
+	}
+	t := d.Center.Sub(or.Origin).Dot(n) / dn
+	if t <= 1e-5 {
+		return NoHit
+	}
+	p := or.At(t)
+	if p.DistanceSquaredTo(d.Center) > d.Radius*d.Radius {
+		return NoHit
+	}
+	return Hit{d, t}
+}
+
+// Maps the disk into the unit square, the center is at (0.5, 0.5)
+func (d Disk) UV(wp Vector3) Vector3 {
+	lp := d.Transform.Inverse().MulPosition(wp).Sub(d.Center)
+	u, v := perpendicularAxes(d.N)
+	return Vector3{0.5 + lp.Dot(u)/(2*d.Radius), 0.5 + lp.Dot(v)/(2*d.Radius), 0}
+}
+
+// Unit normal in world space, transformed by the inverse transpose like Plane.Normal
+func (d Disk) Normal(wp Vector3) Vector3 {
+	return d.Transform.Inverse().Transpose().MulDirection(d.N).Normalize()
+}
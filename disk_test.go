@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDiskIntersect(t *testing.T) {
+	d := Disk{Center: Vector3{0, 0, 100}, N: Vector3{0, 0, -1}, Radius: 10, Transform: Identity()}
+
+	// Centered head on
+	h := d.Intersect(Ray{Vector3{0, 0, 0}, Vector3{0, 0, 1}})
+	if h.Shape == nil || !nearlyEqual(h.T, 100, 1e-12) {
+		t.Errorf("Expected hit at t=100, got %v", h)
+	}
+	if uv := d.UV(Vector3{0, 0, 100}); uv != (Vector3{0.5, 0.5, 0}) {
+		t.Errorf("Expected center UV of (0.5, 0.5), got %v", uv)
+	}
+
+	// Hits the plane of the disk outside its radius
+	if h := d.Intersect(Ray{Vector3{11, 0, 0}, Vector3{0, 0, 1}}); h != NoHit {
+		t.Errorf("Expected ray outside the radius to miss, got %v", h)
+	}
+	if h := d.Intersect(Ray{Vector3{9, 0, 0}, Vector3{0, 0, 1}}); h == NoHit {
+		t.Errorf("Expected ray inside the radius to hit")
+	}
+
+	// Edge on, in the plane of the disk
+	if h := d.Intersect(Ray{Vector3{-50, 0, 100}, Vector3{1, 0, 0}}); h != NoHit {
+		t.Errorf("Expected edge on ray to miss, got %v", h)
+	}
+}
+
+func TestDiskNormalScaled(t *testing.T) {
+	// The local plane x + y = 0 stretched along X becomes x/2 + y = 0
+	m := Translate(Vector3{0, 3, 0}).Mul(Scale(Vector3{2, 1, 1}))
+	s := Disk{Center: Vector3{0, 0, 0}, N: Vector3{1, 1, 0}, Radius: 1, Transform: m}
+	n := s.Normal(Vector3{0, 3, 0})
+	if want := (Vector3{1, 2, 0}).Normalize(); n.DistanceTo(want) > 1e-12 {
+		t.Errorf("Expected normal %v got %v", want, n)
+	}
+	// Perpendicular to directions lying in the transformed surface
+	if d := m.MulDirection(Vector3{1, -1, 0}); math.Abs(n.Dot(d)) > 1e-12 {
+		t.Errorf("Expected %v to be perpendicular to %v", n, d)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Convert a color to the shared exponent RGBE encoding used by Radiance HDR files.
+// Alpha is dropped and negative channels are clamped to 0.
+func encodeRGBE(c Color) [4]byte {
+	r, g, b := math.Max(c.R, 0), math.Max(c.G, 0), math.Max(c.B, 0)
+	v := math.Max(r, math.Max(g, b))
+	if v < 1e-32 {
+		return [4]byte{}
+	}
+	m, e := math.Frexp(v)
+	scale := m * 256 / v
+	return [4]byte{byte(r * scale), byte(g * scale), byte(b * scale), byte(e + 128)}
+}
+
+func decodeRGBE(p [4]byte) Color {
+	if p[3] == 0 {
+		return Color{0, 0, 0, 1}
+	}
+	f := math.Ldexp(1, int(p[3])-(128+8))
+	return Color{(float64(p[0]) + 0.5) * f, (float64(p[1]) + 0.5) * f, (float64(p[2]) + 0.5) * f, 1}
+}
+
+// Write a row major buffer of colors as an uncompressed Radiance HDR image
+func encodeHDR(w io.Writer, width, height int, pix []Color) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n-Y %d +X %d\n", height, width)
+	for _, c := range pix[:width*height] {
+		p := encodeRGBE(c)
+		bw.Write(p[:])
+	}
+	return bw.Flush()
+}
+
+func writeHDR(path string, width, height int, pix []Color) {
+	of, err := os.Create(path)
+	if err != nil {
+		fmt.Printf("Could not create output file: %v", err)
+		return
+	}
+	defer of.Close()
+	err = encodeHDR(of, width, height, pix)
+	if err != nil {
+		fmt.Printf("Encode HDR failed %v", err)
+		return
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+)
+
+func TestHDRRoundTrip(t *testing.T) {
+	const width, height = 3, 2
+	pix := []Color{
+		{0, 0, 0, 1}, {1, 1, 1, 1}, {0.25, 0.5, 0.75, 1},
+		{12.5, 3, 0.01, 1}, {1e-4, 2e-4, 3e-4, 1}, {250, 0, 1000, 1},
+	}
+
+	var buf bytes.Buffer
+	if err := encodeHDR(&buf, width, height, pix); err != nil {
+		t.Fatalf("encodeHDR failed: %v", err)
+	}
+
+	r := bufio.NewReader(&buf)
+	for _, want := range []string{"#?RADIANCE", "FORMAT=32-bit_rle_rgbe", ""} {
+		line, _ := r.ReadString('\n')
+		if line != want+"\n" {
+			t.Fatalf("Expected header line %q got %q", want, line)
+		}
+	}
+	var w, h int
+	if _, err := fmt.Fscanf(r, "-Y %d +X %d\n", &h, &w); err != nil || w != width || h != height {
+		t.Fatalf("Expected resolution %vx%v got %vx%v (%v)", width, height, w, h, err)
+	}
+
+	for i, want := range pix {
+		var p [4]byte
+		if _, err := io.ReadFull(r, p[:]); err != nil {
+			t.Fatalf("Pixel %v: %v", i, err)
+		}
+		got := decodeRGBE(p)
+		// The shared exponent keeps 8 bits of mantissa relative to the largest channel
+		tol := math.Max(want.R, math.Max(want.G, want.B)) / 128
+		if math.Abs(got.R-want.R) > tol || math.Abs(got.G-want.G) > tol || math.Abs(got.B-want.B) > tol {
+			t.Errorf("Pixel %v: expected %v got %v", i, want, got)
+		}
+	}
+	if n, _ := r.Read(make([]byte, 1)); n != 0 {
+		t.Errorf("Expected no trailing data")
+	}
+}
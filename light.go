@@ -0,0 +1,51 @@
+package main
+
+import "math"
+
+// Light sources used to shade the planet surface
+type Light interface {
+	// Given a position in world space return the direction the light travels to
+	// reach it and the intensity arriving there
+	Illuminate(Vector3) (Vector3, float64)
+}
+
+// Infinitely distant light such as the sun
+type DirectionalLight struct {
+	Direction Vector3
+	Intensity float64
+}
+
+// Cone of light from a point, e.g. a searchlight in orbit. Angle is the half angle
+// of the cone in radians. Falloff is the angular width of the soft edge inside the
+// cone over which the intensity ramps down to zero.
+type SpotLight struct {
+	Position  Vector3
+	Direction Vector3
+	Angle     float64
+	Falloff   float64
+	Intensity float64
+}
+
+var (
+	_ Light = DirectionalLight{}
+	_ Light = SpotLight{}
+)
+
+func (l DirectionalLight) Illuminate(p Vector3) (Vector3, float64) {
+	return l.Direction, l.Intensity
+}
+
+func (l SpotLight) Illuminate(p Vector3) (Vector3, float64) {
+	dir := p.Sub(l.Position).Normalize()
+	cosT := dir.Dot(l.Direction.Normalize())
+
+	cosOuter := math.Cos(l.Angle)
+	if cosT <= cosOuter {
+		return dir, 0
+	}
+	cosInner := math.Cos(math.Max(0, l.Angle-l.Falloff))
+	if cosT >= cosInner {
+		return dir, l.Intensity
+	}
+	return dir, l.Intensity * (cosT - cosOuter) / (cosInner - cosOuter)
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestDirectionalLight(t *testing.T) {
+	l := DirectionalLight{Vector3{0, -1, 0}, 2}
+	dir, intensity := l.Illuminate(Vector3{100, 200, 300})
+	if dir != l.Direction || intensity != 2 {
+		t.Errorf("Expected %v, %v got %v, %v", l.Direction, 2, dir, intensity)
+	}
+}
+
+func TestSpotLight(t *testing.T) {
+	// Searchlight in orbit pointing straight down at the planet
+	l := SpotLight{
+		Position:  Vector3{0, 2 * EarthRadius, 0},
+		Direction: Vector3{0, -1, 0},
+		Angle:     0.1,
+		Falloff:   0.02,
+		Intensity: 5,
+	}
+	n := Vector3{0, 1, 0}
+
+	inside := Vector3{0, EarthRadius, 0}
+	dir, intensity := l.Illuminate(inside)
+	if lit := -n.Dot(dir) * intensity; !nearlyEqual(lit, 5, 1e-12) {
+		t.Errorf("Expected point inside the cone to be fully lit, got %v", lit)
+	}
+
+	outside := Vector3{EarthRadius, EarthRadius, 0}
+	if _, intensity := l.Illuminate(outside); intensity != 0 {
+		t.Errorf("Expected point outside the cone to receive no light, got %v", intensity)
+	}
+
+	// Point at 0.09 radians from the axis is within the soft edge
+	edge := Vector3{EarthRadius * 0.0902, EarthRadius, 0}
+	if _, intensity := l.Illuminate(edge); intensity <= 0 || intensity >= 5 {
+		t.Errorf("Expected partial intensity in the falloff region, got %v", intensity)
+	}
+}
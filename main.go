@@ -3,12 +3,19 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"image"
 	"image/color"
+	"image/jpeg"
 	"image/png"
 	"math"
 	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -17,6 +24,12 @@ const (
 
 	EarthRadius           = 6371000 // meters
 	EarthAtmosphereHeight = 100000  // meters
+
+	// Relative distance a ray is advanced past a surface it hit, see advanceRay
+	RayEpsilon = 1e-9
+	// Distance in meters the origin of a shadow ray is moved towards the light, so
+	// that points on a surface lit by the light do not shadow themselves
+	ShadowRayEpsilon = 0.01
 )
 
 type Ray struct {
@@ -24,15 +37,28 @@ type Ray struct {
 	Direction Vector3
 }
 
+// Position at parameter t along the ray, t is a distance when Direction is unit length
+func (r Ray) At(t float64) Vector3 {
+	return r.Direction.Multiply(t).Add(r.Origin)
+}
+
 type Hit struct {
 	Shape Shape
 	T     float64
 }
 
 var (
-	NoHit             = Hit{nil, 1e9}
+	NoHit = Hit{nil, 1e9}
+
+	// Defaults for new scenes
+	PlanetCenter      = Vector3{0, 0, 0}
 	SunlightDir       = Vector3{3, -5, 1}.Normalize()
 	SunlightIntensity = 3.0
+	// Angular radius of the sun in radians. With anti-aliasing on, shadow rays are
+	// spread over the disk so the terminator is softened, 0 gives hard shadows.
+	SunAngularRadius = 0.27 * math.Pi / 180
+	// Distance in meters from the planet to the disk drawn for the sun
+	SunDistance = 1.496e11
 
 	// Rayleight extinction coefficients computed for R, G and B wavelengths.
 	// We use the wavelengths from Hoffman and Preetham of [650, 570, 475]nm and matched
@@ -44,19 +70,63 @@ var (
 	// These values were taken from Bruneton
 	MieExtinction   = Color{2.3e-06, 2.3e-06, 2.3e-06, 0}
 	MieDensityScale = 0.1
+	// Asymmetry factor for the Mie phase function, > 0 favors forward scattering
+	MieG = 0.76
+
+	// Ozone absorption coefficients for R, G and B wavelengths at the peak of the
+	// ozone layer. Ozone absorbs without scattering, mostly in the green and red,
+	// which keeps the zenith blue at twilight. Values taken from Bruneton.
+	OzoneAbsorption = Color{0.650e-06, 1.881e-06, 0.085e-06, 0}
+	// Altitude in meters of the ozone density peak and the total thickness of
+	// the layer, density falls off linearly to zero either side of the peak
+	OzoneCenterAltitude = 25000.0
+	OzoneWidth          = 30000.0
+
+	// Maximum distance in meters between view ray integration samples. Long grazing
+	// paths through the atmosphere get more samples to keep the step bounded.
+	// 0 disables the limit.
+	MaxIntegrationStep = 20000.0
+
+	// Cheap stand-in for multiple scattering. Each further bounce is assumed to add
+	// this fraction of the light scattered by the bounce before it, so the single
+	// scattered light is scaled by the geometric series 1/(1-f). Must be in [0,1),
+	// 0 gives single scattering only.
+	MultiScatterFactor = 0.0
+
+	// Albedo of scene shapes other than the textured planet
+	ShapeAlbedo = Color{0.5, 0.5, 0.5, 1}
+	// Albedo of the planet when it has no texture, loud so that it is obvious
+	MissingTextureAlbedo = Color{1, 0, 1, 1}
+
+	// Crude approximation of the skylight that reaches the night side through
+	// multiple scattering, scaled by Scene.Ambient
+	AmbientSky = Color{0.02, 0.03, 0.05, 0}
+
+	// Width of the band past the terminator, as the cosine of the angle between
+	// the surface normal and the sun, over which the night texture fades in
+	NightBlendWidth = 0.1
 )
 
-var debugIntersect bool
-
 type Shape interface {
 	// Test if the world space ray hit the object
 	Intersect(Ray) Hit
 	// Given a position in world space compute and return UV coordinates in X & Y components
 	UV(Vector3) Vector3
-	// Given a position in world space return the normal in object space
+	// Given a position in world space return the normal in world space
 	Normal(Vector3) Vector3
 }
 
+// Returns the nearest hit of the ray across all the shapes, NoHit if it misses them all
+func closestHit(r Ray, shapes []Shape) Hit {
+	closest := NoHit
+	for _, shape := range shapes {
+		if h := shape.Intersect(r); h.T < closest.T {
+			closest = h
+		}
+	}
+	return closest
+}
+
 type Sphere struct {
 	Origin    Vector3
 	Radius    float64
@@ -71,10 +141,99 @@ func (a Color) AddRGB(b Color) Color {
 	return Color{a.R + b.R, a.G + b.G, a.B + b.B, a.A}
 }
 
+func (a Color) SubRGB(b Color) Color {
+	return Color{a.R - b.R, a.G - b.G, a.B - b.B, a.A}
+}
+
 func (c Color) MultiplyRGB(f float64) Color {
 	return Color{c.R * f, c.G * f, c.B * f, c.A}
 }
 
+func (c Color) DivideRGB(f float64) Color {
+	return Color{c.R / f, c.G / f, c.B / f, c.A}
+}
+
+// Whether the RGB components are all zero, alpha is ignored
+func (c Color) IsBlack() bool {
+	return c.R == 0 && c.G == 0 && c.B == 0
+}
+
+// RGB components as a vector, alpha is dropped
+func (c Color) ToVector3() Vector3 {
+	return Vector3{c.R, c.G, c.B}
+}
+
+// Channel-wise product of the RGB components, alpha is kept from a
+func (a Color) MultiplyColor(b Color) Color {
+	return Color{a.R * b.R, a.G * b.G, a.B * b.B, a.A}
+}
+
+// Linearly interpolate all four channels from a to b, t is not clamped
+func (a Color) Lerp(b Color, t float64) Color {
+	return Color{a.R + (b.R-a.R)*t, a.G + (b.G-a.G)*t, a.B + (b.B-a.B)*t, a.A + (b.A-a.A)*t}
+}
+
+// Clamp each RGB channel to [0,1], alpha is left alone
+func (c Color) Clamp01() Color {
+	return Color{clamp(c.R, 0, 1), clamp(c.G, 0, 1), clamp(c.B, 0, 1), c.A}
+}
+
+// Scale RGB by alpha, converting a straight alpha color to premultiplied alpha
+func (c Color) Premultiply() Color {
+	return Color{c.R * c.A, c.G * c.A, c.B * c.A, c.A}
+}
+
+// Divide RGB by alpha, converting a premultiplied alpha color back to straight alpha.
+// A fully transparent color has no recoverable RGB and returns transparent black.
+func (c Color) Unpremultiply() Color {
+	if c.A == 0 {
+		return Color{}
+	}
+	return Color{c.R / c.A, c.G / c.A, c.B / c.A, c.A}
+}
+
+// Porter-Duff over operator, composites c on top of bg. Unlike AddRGB and
+// MultiplyRGB this operates on all four channels and both c and bg must be
+// premultiplied. The result is premultiplied.
+func (c Color) CompositeOver(bg Color) Color {
+	k := 1 - c.A
+	return Color{c.R + bg.R*k, c.G + bg.G*k, c.B + bg.B*k, c.A + bg.A*k}
+}
+
+// Reinhard tone mapping, compresses each RGB channel with c/(c+1)
+func (c Color) TonemapReinhard() Color {
+	return Color{c.R / (c.R + 1), c.G / (c.G + 1), c.B / (c.B + 1), c.A}
+}
+
+// Narkowicz's fit of the ACES filmic tone curve, RGB channels are mapped into [0,1]
+func (c Color) TonemapACES() Color {
+	aces := func(x float64) float64 {
+		return clamp((x*(2.51*x+0.03))/(x*(2.43*x+0.59)+0.14), 0, 1)
+	}
+	return Color{aces(c.R), aces(c.G), aces(c.B), c.A}
+}
+
+// Raise RGB to the power 1/gamma to encode linear radiance for display, alpha is
+// left alone. Negative channels are clamped to 0 first so they don't produce NaNs.
+func (c Color) GammaEncode(gamma float64) Color {
+	g := 1 / gamma
+	enc := func(x float64) float64 {
+		return math.Pow(math.Max(x, 0), g)
+	}
+	return Color{enc(c.R), enc(c.G), enc(c.B), c.A}
+}
+
+// Replace NaN and infinite channels with 0, so a bad sample can't pack to garbage
+func (c Color) Sanitize() Color {
+	fix := func(x float64) float64 {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return 0
+		}
+		return x
+	}
+	return Color{fix(c.R), fix(c.G), fix(c.B), fix(c.A)}
+}
+
 // Convert the color to color.RGBA and does [0,255] clamping
 func (c Color) Pack() color.NRGBA {
 	uR := uint8(clamp(c.R*255, 0, 255))
@@ -85,57 +244,184 @@ func (c Color) Pack() color.NRGBA {
 	return color.NRGBA{uR, uG, uB, uA}
 }
 
+// Parse a comma separated "r,g,b" triple into an opaque color
+func parseRGB(s string) (Color, error) {
+	rgb, err := parseTriple(s, "r,g,b")
+	if err != nil {
+		return Color{}, err
+	}
+	return Color{rgb[0], rgb[1], rgb[2], 1}, nil
+}
+
+// Parse a vector given as x,y,z
+func parseVector3(s string) (Vector3, error) {
+	xyz, err := parseTriple(s, "x,y,z")
+	if err != nil {
+		return Vector3{}, err
+	}
+	return Vector3{xyz[0], xyz[1], xyz[2]}, nil
+}
+
+// Parse three comma separated numbers, form names them for the error message
+func parseTriple(s, form string) ([3]float64, error) {
+	var v [3]float64
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return v, fmt.Errorf("expected %s but got %q", form, s)
+	}
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return v, fmt.Errorf("invalid component %q in %q: %v", p, s, err)
+		}
+		v[i] = f
+	}
+	return v, nil
+}
+
 func NewColorFromRGBA(r, g, b, a uint32) Color {
 	return Color{float64(r) / 65536, float64(g) / 65536, float64(b) / 65536, float64(a) / 65536}
 }
 
 var _ Shape = &Sphere{}
 
-func nextFloatUp(v float64) float64 {
-	return math.Nextafter(v, math.Inf(1))
+// Advance the ray origin to just past the hit at t, to avoid intersecting the same
+// surface again. A single ULP step is lost in rounding at planetary distances so
+// the offset is scaled by the magnitude of the coordinates involved.
+func advanceRay(r Ray, t float64) Ray {
+	eps := RayEpsilon * math.Max(1, r.Origin.Length()+t)
+	return Ray{r.At(t + eps), r.Direction}
 }
 
 // From https://github.com/fogleman/pt/blob/69e74a07b0af72f1601c64120a866d9a5f432e2f/pt/sphere.go#L26-L43
 func (s Sphere) Intersect(r Ray) Hit {
 	// Ray is in world space, transform the ray into local space
-	or := s.Transform.Inverse().MulRay(r)
+	inv, ok := s.Transform.TryInverse()
+	if !ok {
+		// A degenerate transform squashes the shape flat, there is nothing to hit
+		return NoHit
+	}
+	// The local direction is not normalized so hit distances are world distances
+	// even if the transform scales
+	or := inv.TransformRay(r)
 
 	to := or.Origin.Sub(s.Origin)
+	a := or.Direction.Dot(or.Direction)
 	b := to.Dot(or.Direction)
 	c := to.Dot(to) - s.Radius*s.Radius
-	d := b*b - c
+	d := b*b - a*c
 	if d > 0 {
 		d = math.Sqrt(d)
-		t1 := -b - d
+		t1 := (-b - d) / a
 		if t1 > 1e-5 {
 			return Hit{s, t1}
 		}
-		t2 := -b + d
+		t2 := (-b + d) / a
 		if t2 > 1e-5 {
 			return Hit{s, t2}
 		}
+		// A ray starting inside the sphere always leaves it, even when it starts
+		// so close to the surface that the exit is nearer than the threshold
+		if c < 0 {
+			return Hit{s, math.Max(t2, 0)}
+		}
 	}
 
 	return NoHit
 }
 
+// Cheaper alternative to Intersect for occlusion queries that only need to know
+// whether the ray hits the sphere, not where. Uses the distance of closest approach
+// between the ray and the sphere center instead of solving for the hit points.
+func (s Sphere) Occludes(r Ray) bool {
+	inv, ok := s.Transform.TryInverse()
+	if !ok {
+		return false
+	}
+	// Same local ray as Intersect, the direction is not normalized
+	or := inv.TransformRay(r)
+
+	to := or.Origin.Sub(s.Origin)
+	r2 := s.Radius * s.Radius
+	d2 := to.Dot(to)
+	if d2 <= r2 {
+		// Origin is on or inside the surface, defer to Intersect so that
+		// points on the surface are treated the same way
+		return s.Intersect(r) != NoHit
+	}
+	// Closest approach is behind the ray origin
+	b := to.Dot(or.Direction)
+	if b >= 0 {
+		return false
+	}
+	a := or.Direction.Dot(or.Direction)
+	return d2-b*b/a < r2
+}
+
 // p is in shape coordinate space
 // returned vector only sets x & y components for u & v coords
 // From https://github.com/fogleman/pt/blob/69e74a07b0af72f1601c64120a866d9a5f432e2f/pt/sphere.go#L45-L52
 func (s Sphere) UV(wp Vector3) Vector3 {
 	p := s.Transform.Inverse().MulPosition(wp)
-	p = p.Sub(s.Origin)
-	u := math.Atan2(p.Z, p.X)
-	v := math.Atan2(p.Y, Vector3{p.X, 0, p.Z}.Length())
+	return directionUV(p.Sub(s.Origin))
+}
+
+// Tangent frame at world space point wp on the sphere, consistent with UV. tangent
+// points along increasing u, east, and bitangent along increasing v, south. With the
+// surface normal they form an orthonormal basis. At the poles, where u is undefined,
+// the frame follows u = 0.5.
+func (s Sphere) Tangent(wp Vector3) (tangent, bitangent Vector3) {
+	p := s.Transform.Inverse().MulPosition(wp).Sub(s.Origin)
+	phi := math.Atan2(p.Z, p.X)
+	t := Vector3{-math.Sin(phi), 0, math.Cos(phi)}
+	b := p.Normalize().Cross(t)
+	return s.Transform.MulDirection(t).Normalize(), s.Transform.MulDirection(b).Normalize()
+}
+
+// Longitude and latitude of direction d mapped to equirectangular texture
+// coordinates in the X and Y components. v is 0 straight up. d need not be unit
+// length.
+func directionUV(d Vector3) Vector3 {
+	u := math.Atan2(d.Z, d.X)
+	v := math.Atan2(d.Y, Vector3{d.X, 0, d.Z}.Length())
 	u = (u + math.Pi) / (2 * math.Pi)
 	v = (math.Pi - (v + math.Pi/2)) / math.Pi
 	return Vector3{u, v, 0}
 }
 
+// Unit surface normal at world space position wp. Normals transform by the inverse
+// transpose so they stay perpendicular to the surface under non-uniform scaling.
 func (s Sphere) Normal(wp Vector3) Vector3 {
-	p := s.Transform.Inverse().MulPosition(wp)
-	p = p.Sub(s.Origin)
-	return p.Normalize()
+	inv := s.Transform.Inverse()
+	p := inv.MulPosition(wp).Sub(s.Origin)
+	return inv.Transpose().MulDirection(p).Normalize()
+}
+
+// Center of the sphere in world space
+func (s Sphere) Center() Vector3 {
+	return s.Transform.MulPosition(s.Origin)
+}
+
+// Height of a world space position above the surface of the sphere, negative if inside.
+// It is called for every atmosphere density sample so rather than inverting the
+// transform it assumes the transform is rigid, see Matrix.IsRigid. Scene.Check
+// enforces this for the planet and atmosphere.
+func (s Sphere) Altitude(wp Vector3) float64 {
+	return wp.Sub(s.Center()).Length() - s.Radius
+}
+
+// Returns true if the world space position is strictly inside the sphere. Like
+// Altitude the transform must be rigid.
+func (s Sphere) Contains(wp Vector3) bool {
+	return s.Altitude(wp) < 0
+}
+
+// Henyey-Greenstein approximation of the Mie phase function. cosTheta is the cosine of
+// the angle between the light's direction of travel and the scattered direction, g is
+// the asymmetry factor.
+func miePhase(cosTheta, g float64) float64 {
+	g2 := g * g
+	return (1 - g2) / (4 * math.Pi * math.Pow(1+g2-2*g*cosTheta, 1.5))
 }
 
 // Numerical integrator using the trapezoidal rule
@@ -158,6 +444,42 @@ func numIntegrate(fn func(_, _ float64) float64, a, b float64, n int) float64 {
 	return (area * dx) * 0.5
 }
 
+// Numerical integrator using composite Simpson's rule, which converges faster than
+// the trapezoidal rule for smooth functions. Integrates fn(x) over [a,b] in n steps.
+// Simpson's rule needs an even number of intervals, when n is even the last three
+// intervals use Simpson's 3/8 rule instead. Fewer than 3 steps falls back to
+// numIntegrate.
+func numIntegrateSimpson(fn func(_, _ float64) float64, a, b float64, n int) float64 {
+	if n < 3 {
+		return numIntegrate(fn, a, b, n)
+	}
+	dx := (b - a) / float64(n-1)
+
+	m := n - 1
+	if m%2 == 1 {
+		m -= 3
+	}
+
+	var area float64
+	if m > 0 {
+		area = fn(a, dx) + fn(a+float64(m)*dx, dx)
+		for i := 1; i < m; i++ {
+			w := 2.0
+			if i%2 == 1 {
+				w = 4
+			}
+			area += w * fn(a+float64(i)*dx, dx)
+		}
+		area *= dx / 3
+	}
+	if m < n-1 {
+		// Simpson's 3/8 rule over the remaining three intervals
+		x := a + float64(m)*dx
+		area += 3 * dx / 8 * (fn(x, dx) + 3*fn(x+dx, dx) + 3*fn(x+2*dx, dx) + fn(b, dx))
+	}
+	return area
+}
+
 // Same as numIntegrate but integrates a vector function fn(x)
 func numIntegrateV(fn func(_, _ float64) Vector3, a, b float64, n int) Vector3 {
 	dx := (b - a) / float64(n-1)
@@ -177,10 +499,106 @@ func numIntegrateV(fn func(_, _ float64) Vector3, a, b float64, n int) Vector3 {
 	return area.Multiply(dx * 0.5)
 }
 
+// Same as numIntegrateV but accumulates with Kahan compensated summation, carrying
+// the rounding error of each component into the next step. Slower, but long paths
+// with many small contributions do not drift.
+func numIntegrateVKahan(fn func(_, _ float64) Vector3, a, b float64, n int) Vector3 {
+	dx := (b - a) / float64(n-1)
+
+	var area, comp Vector3
+	prevfn := fn(a, dx)
+	for i := 1; i < n; i++ {
+		// Step from a each time so x does not accumulate error either
+		newfn := fn(a+float64(i)*dx, dx)
+		y := prevfn.Add(newfn).Sub(comp)
+		t := area.Add(y)
+		comp = t.Sub(area).Sub(y)
+		area = t
+
+		prevfn = newfn
+	}
+
+	return area.Multiply(dx * 0.5)
+}
+
+// Maximum recursion depth of numIntegrateVAdaptive, bounds the work spent on
+// integrands that never converge
+const adaptiveMaxDepth = 20
+
+// Integrates vector function fn(x) over [a,b] with adaptive Simpson's rule. Each
+// interval is split in half until the two halves agree with the whole to within tol
+// in every component, so samples gather where fn changes quickly. Returns the result
+// and the number of times fn was evaluated.
+func numIntegrateVAdaptive(fn func(_, _ float64) Vector3, a, b, tol float64) (Vector3, int) {
+	h := (b - a) / 2
+	fa, fm, fb := fn(a, h), fn(a+h, h), fn(b, h)
+	evals := 3
+	whole := simpsonV(fa, fm, fb, b-a)
+	return adaptiveSimpsonV(fn, a, b, fa, fm, fb, whole, tol, adaptiveMaxDepth, &evals), evals
+}
+
+// Simpson's rule over an interval of the given width from the values at its ends and
+// midpoint
+func simpsonV(fa, fm, fb Vector3, width float64) Vector3 {
+	return fa.Add(fm.Multiply(4)).Add(fb).Multiply(width / 6)
+}
+
+func adaptiveSimpsonV(fn func(_, _ float64) Vector3, a, b float64, fa, fm, fb, whole Vector3, tol float64, depth int, evals *int) Vector3 {
+	m := (a + b) / 2
+	h := (b - a) / 4
+	flm, frm := fn(a+h, h), fn(b-h, h)
+	*evals += 2
+
+	left, right := simpsonV(fa, flm, fm, m-a), simpsonV(fm, frm, fb, b-m)
+	diff := left.Add(right).Sub(whole)
+	d := diff.Abs()
+	if depth <= 0 || math.Max(d.X, math.Max(d.Y, d.Z)) <= 15*tol {
+		// Richardson extrapolation removes most of the remaining error
+		return left.Add(right).Add(diff.Divide(15))
+	}
+	return adaptiveSimpsonV(fn, a, m, fa, flm, fm, left, tol/2, depth-1, evals).
+		Add(adaptiveSimpsonV(fn, m, b, fm, frm, fb, right, tol/2, depth-1, evals))
+}
+
+// Number of samples to integrate over a path of the given length. At least n samples
+// are used, more if needed to keep the distance between samples within maxStep.
+func integrationSteps(length float64, n int, maxStep float64) int {
+	if maxStep <= 0 {
+		return n
+	}
+	need := int(math.Ceil(length/maxStep)) + 1
+	if need > n {
+		return need
+	}
+	return n
+}
+
 func clamp(x, min, max float64) float64 {
 	return math.Max(math.Min(x, max), min)
 }
 
+const minNormal = 2.2250738585072014e-308 // Smallest positive normal value of type float64
+
+// Returns true if two floating point numbers are within epsilon of each other
+func nearlyEqual(a, b, epsilon float64) bool {
+	diff := math.Abs(a - b)
+
+	if a == b {
+		return true
+	} else if a == 0 || b == 0 || diff < minNormal {
+		return diff < (epsilon * minNormal)
+	} else {
+		absA, absB := math.Abs(a), math.Abs(b)
+		return diff/math.Min((absA+absB), math.MaxFloat64) < epsilon
+	}
+}
+
+// Final color = planet color + Fin, where the in-scattered light Fin is scaled
+// by the atmosphere tint. The planet color is left untouched by the tint.
+func addInScatter(surface, inScatter, tint Color) Color {
+	return surface.AddRGB(Color{inScatter.R * tint.R, inScatter.G * tint.G, inScatter.B * tint.B, inScatter.A})
+}
+
 // Nearest neighbor
 func sampleTexture(img image.Image, u, v float64) Color {
 	bounds := img.Bounds()
@@ -190,167 +608,325 @@ func sampleTexture(img image.Image, u, v float64) Color {
 	return NewColorFromRGBA(r, g, b, a)
 }
 
+// Bilinear interpolation of the four texels surrounding u, v. u is longitude and
+// wraps around so there is no seam at the edges of the texture, v is clamped.
+func sampleTextureBilinear(img image.Image, u, v float64) Color {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	// Texel centers are at half integer coordinates
+	fx := u*float64(w) - 0.5
+	fy := clamp(v*float64(h)-0.5, 0, float64(h-1))
+	x0, y0 := math.Floor(fx), math.Floor(fy)
+	tx, ty := fx-x0, fy-y0
+
+	wrap := func(x int) int {
+		return ((x%w)+w)%w + bounds.Min.X
+	}
+	texel := func(x, y int) Color {
+		if y >= h {
+			y = h - 1
+		}
+		r, g, b, a := img.At(wrap(x), y+bounds.Min.Y).RGBA()
+		return NewColorFromRGBA(r, g, b, a)
+	}
+	lerp := func(a, b Color, t float64) Color {
+		return Color{a.R + (b.R-a.R)*t, a.G + (b.G-a.G)*t, a.B + (b.B-a.B)*t, a.A + (b.A-a.A)*t}
+	}
+
+	ix, iy := int(x0), int(y0)
+	top := lerp(texel(ix, iy), texel(ix+1, iy), tx)
+	bottom := lerp(texel(ix, iy+1), texel(ix+1, iy+1), tx)
+	return lerp(top, bottom, ty)
+}
+
+// How a texture is sampled between texels
+type TextureFilter int
+
+const (
+	FilterNearest TextureFilter = iota
+	FilterBilinear
+)
+
+func parseTextureFilter(s string) (TextureFilter, error) {
+	switch s {
+	case "nearest":
+		return FilterNearest, nil
+	case "bilinear":
+		return FilterBilinear, nil
+	}
+	return FilterNearest, fmt.Errorf("unknown texture filter %q, expected nearest or bilinear", s)
+}
+
+// Sample the texture at u, v using the filter
+func (f TextureFilter) Sample(img image.Image, u, v float64) Color {
+	if f == FilterBilinear {
+		return sampleTextureBilinear(img, u, v)
+	}
+	return sampleTexture(img, u, v)
+}
+
+// Operator applied to rendered colors before they are packed into the image
+type ToneMapping int
+
+const (
+	ToneMapNone ToneMapping = iota
+	ToneMapReinhard
+	ToneMapACES
+)
+
+func parseToneMapping(s string) (ToneMapping, error) {
+	switch s {
+	case "none":
+		return ToneMapNone, nil
+	case "reinhard":
+		return ToneMapReinhard, nil
+	case "aces":
+		return ToneMapACES, nil
+	}
+	return ToneMapNone, fmt.Errorf("unknown tone mapping %q, expected none, reinhard or aces", s)
+}
+
+func (t ToneMapping) Apply(c Color) Color {
+	switch t {
+	case ToneMapReinhard:
+		return c.TonemapReinhard()
+	case ToneMapACES:
+		return c.TonemapACES()
+	}
+	return c
+}
+
 func main() {
-	f, err := os.Open("earth.png")
-	if err != nil {
-		fmt.Printf("err reading 'earth.png': %v\n", err)
+	cpuProfile := flag.String("cpuprofile", "", "write a CPU profile to this file")
+	check := flag.Bool("check", false, "validate the scene parameters and exit without rendering")
+	texture := flag.String("texture", "earth.png", "PNG albedo texture for the planet, or checker for a checkerboard showing the UV mapping")
+	ambient := flag.Float64("ambient", 0, "scale of the constant sky light added to the night side of surfaces, 0 disables it")
+	background := flag.String("background", "", "optional PNG equirectangular background, e.g. a star map, seen by rays that miss the planet")
+	normalMap := flag.String("normalMap", "", "optional PNG tangent space normal map bending the planet normals used for lighting")
+	nightTexture := flag.String("nightTexture", "", "optional PNG emissive texture, e.g. city lights, drawn on the night side of the planet")
+	width := flag.Int("width", ImageWidth, "width of the output image in pixels")
+	height := flag.Int("height", ImageHeight, "height of the output image in pixels")
+	out := flag.String("out", "", "path of the output image (default out.png or out.hdr)")
+	format := flag.String("format", "png", "output format, png, jpeg or hdr. hdr writes linear radiance without tone mapping or gamma")
+	quality := flag.Int("quality", 90, "jpeg quality from 1 to 100")
+	var textureFilter TextureFilter
+	var toneMapping ToneMapping
+	aa := flag.Int("aa", 1, "anti-aliasing, render an NxN grid of jittered sub-samples per pixel")
+	frames := flag.Int("frames", 1, "number of frames with different anti-aliasing jitter averaged into the output")
+	threads := flag.Int("threads", runtime.NumCPU(), "number of goroutines rendering the image")
+	tile := flag.Int("tile", 0, "render square tiles of this many pixels instead of scanlines and report progress, 0 renders scanlines")
+	slice := flag.Bool("slice", false, "render a 2D cross-section of the atmosphere density instead of the camera view")
+	var sliceField SliceField
+	flag.Func("sliceField", "quantity drawn by -slice, density or inscatter (default density)", func(s string) error {
+		f, err := parseSliceField(s)
+		sliceField = f
+		return err
+	})
+	viewSamples := flag.Int("viewSamples", 50, "in-scattering integration samples along each view ray")
+	sunSamples := flag.Int("sunSamples", 5, "optical length integration samples along each sun ray, or each -depthTable entry")
+	flag.Float64Var(&MultiScatterFactor, "multiScatter", MultiScatterFactor, "fraction of the scattered light added back by each further bounce, 0 for single scattering only")
+	flag.Float64Var(&MaxIntegrationStep, "max-integration-distance", MaxIntegrationStep, "maximum distance in meters between view ray integration samples, 0 for no limit")
+	flag.Func("filter", "earth texture filtering, nearest or bilinear (default nearest)", func(s string) error {
+		f, err := parseTextureFilter(s)
+		textureFilter = f
+		return err
+	})
+	gamma := flag.Float64("gamma", 1, "gamma encode the output, e.g. 2.2 for sRGB displays, 1 writes linear values")
+	skyOnly := flag.Bool("skyonly", false, "render only the atmosphere seen from the ground against a black void, without the planet")
+	cutoff := flag.Float64("cutoff", 0, "stop integrating the in-scattered light once the view ray transmittance falls below this, 0 integrates the whole path")
+	animFrames := flag.Int("animFrames", 1, "render this many images with the sun turning a full circle about -animAxis, numbered out_000.png, out_001.png, ...")
+	animAxis := Vector3{0, 1, 0}
+	flag.Func("animAxis", "x,y,z axis the sun turns about in an animation (default 0,1,0)", func(s string) error {
+		v, err := parseVector3(s)
+		if err != nil {
+			return err
+		}
+		if v.Length() == 0 {
+			return fmt.Errorf("the axis must not be zero")
+		}
+		animAxis = v
+		return nil
+	})
+	sunDisk := flag.Bool("sunDisk", false, "draw the sun as a disk of its angular radius where it is in view")
+	earthshine := flag.Bool("earthshine", false, "light the atmosphere with sunlight reflected off the planet surface, slower")
+	denoise := flag.Int("denoise", 0, "radius in pixels of a box blur applied before tone mapping to hide noise, 0 disables it")
+	spectral := flag.Int("spectral", 0, "compute the in-scattered light at this many wavelengths across the visible range and convert to RGB, 0 uses the three RGB wavelengths")
+	depthTable := flag.Int("depthTable", 64, "resolution in each dimension of the precomputed sunlight optical depth table, 0 integrates every sun ray with -sunSamples samples")
+	flag.Func("tonemap", "tone mapping applied before output, none, reinhard or aces (default none)", func(s string) error {
+		t, err := parseToneMapping(s)
+		toneMapping = t
+		return err
+	})
+	atmosphereTint := Color{1, 1, 1, 1}
+	flag.Func("atmosphere-tint", "r,g,b multiplier applied to the in-scattered light (default 1,1,1)", func(s string) error {
+		c, err := parseRGB(s)
+		atmosphereTint = c
+		return err
+	})
+	flag.Parse()
+	if *format != "png" && *format != "jpeg" && *format != "hdr" {
+		fmt.Printf("unknown output format %q, expected png, jpeg or hdr\n", *format)
 		os.Exit(1)
 	}
-	tex, err := png.Decode(f)
-	if err != nil {
-		fmt.Printf("err reading 'earth.png': %v\n", err)
-		f.Close()
+	if *quality < 1 || *quality > 100 {
+		fmt.Printf("jpeg quality %v must be between 1 and 100\n", *quality)
+		os.Exit(1)
+	}
+	if *out == "" {
+		*out = "out." + *format
+	}
+	if *animFrames < 1 {
+		fmt.Printf("animation frame count %v must be at least 1\n", *animFrames)
+		os.Exit(1)
+	}
+	if *slice && *format != "png" {
+		fmt.Printf("the slice view can only be written as png\n")
 		os.Exit(1)
 	}
-	f.Close()
 
-	img := image.NewRGBA(image.Rect(0, 0, ImageWidth, ImageHeight))
+	scene := NewScene(nil)
+	if *skyOnly {
+		scene = NewSkyScene()
+	}
+	scene.Width, scene.Height = *width, *height
+	scene.Threads = *threads
+	scene.AA = *aa
+	scene.Frames = *frames
+	scene.Ambient = *ambient
+	scene.ViewSamples, scene.SunSamples = *viewSamples, *sunSamples
+	scene.TextureFilter = textureFilter
+	scene.ToneMapping = toneMapping
+	scene.Gamma = *gamma
+	scene.DepthTableAltitudes, scene.DepthTableAngles = *depthTable, *depthTable
+	scene.Denoise = *denoise
+	scene.Earthshine = *earthshine
+	scene.AtmosphereTint = atmosphereTint
+	if *sunDisk {
+		scene.SunDisk = NewSunDisk(scene.Planet.Center(), scene.Sun.Direction)
+	}
+	scene.TransmittanceCutoff = *cutoff
+	if *spectral > 0 {
+		scene.Wavelengths = UniformWavelengths(*spectral)
+	}
 
-	// World space -> Camera space
-	// Increase World X -> Move right in the camera
-	// Increase World Y -> Move up in the camera
-	// Increase World Z -> Move away from the camera (into screen)
-	so := Sphere{Vector3{0, 0, 0}, EarthRadius + EarthAtmosphereHeight, Identity()}
-	si := Sphere{Vector3{0, 0, 0}, EarthRadius, Rotate(Vector3{0, 1, 0}, -0.5)}
+	if errs := scene.Check(); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Printf("Invalid scene: %v\n", err)
+		}
+		os.Exit(1)
+	}
+	if *check {
+		fmt.Printf("Scene OK\n")
+		return
+	}
 
-	for y := 0; y < ImageHeight; y++ {
-		for x := 0; x < ImageWidth; x++ {
-			var dir Vector3
-			dir.X = (float64(x-ImageWidth/2) / (ImageWidth / 2)) * (float64(ImageWidth) / ImageHeight)
-			dir.Y = float64(ImageHeight/2-y) / (ImageHeight / 2)
-			dir.Z = 5
+	// Started once all the flags are validated, the deferred stop does not run if
+	// main exits through os.Exit
+	if *cpuProfile != "" {
+		stop, err := startCPUProfile(*cpuProfile)
+		if err != nil {
+			fmt.Printf("warning: could not start CPU profile: %v\n", err)
+		} else {
+			defer stop()
+		}
+	}
 
-			c := Color{0, 0, 0, 1}
-			r := Ray{Vector3{0, 0, -40 * 1000 * 1000}, dir.Normalize()}
+	if *slice {
+		writePNG(*out, scene.RenderSlice(sliceField))
+		return
+	}
 
-			// Does it hit the planet outer atmosphere?
-			debugIntersect = x == 320 && (y == 400 || y == 80 || y == 240)
-			debugIntersect = false
-			if debugIntersect {
-				fmt.Printf("y %v\n", y)
-			}
+	if *texture == "checker" {
+		scene.Texture = NewCheckerTexture()
+	} else if tex, err := loadPNG(*texture); err != nil {
+		fmt.Printf("warning: err reading %q, the planet will be drawn without a texture: %v\n", *texture, err)
+	} else {
+		scene.Texture = tex
+	}
+	if *nightTexture != "" {
+		tex, err := loadPNG(*nightTexture)
+		if err != nil {
+			fmt.Printf("warning: err reading %q, the night side will be drawn without it: %v\n", *nightTexture, err)
+		} else {
+			scene.NightTexture = tex
+		}
+	}
+	if *normalMap != "" {
+		tex, err := loadPNG(*normalMap)
+		if err != nil {
+			fmt.Printf("warning: err reading %q, the planet will be lit without it: %v\n", *normalMap, err)
+		} else {
+			scene.NormalMap = tex
+		}
+	}
+	if *background != "" {
+		tex, err := loadPNG(*background)
+		if err != nil {
+			fmt.Printf("warning: err reading %q, the background will be black: %v\n", *background, err)
+		} else {
+			scene.Background = tex
+		}
+	}
 
-			// Ray definitions
-			// r - the starting ray from the camera into the scene
-			// ri - from the hit point on outer atmosphere this ray is in the same direction
-			//   as r. used to find if the view ray hits the planet or exits the atmosphere
-			// rs - ray from a point in the atmosphere back towards the sun
-			// rc - ray from a point back towards the camera
-
-			// Does it hit the planet outer atmosphere?
-			ho := so.Intersect(r)
-			if ho != NoHit {
-				// Advance along ray very slightly to avoid intersecting
-				// planet atmosphere again
-				t1 := nextFloatUp(ho.T)
-				// Compute start point for the ray
-				ri := Ray{r.Direction.Multiply(t1).Add(r.Origin), r.Direction}
-
-				var olE float64
-
-				// Does it hit the planet?
-				hi := si.Intersect(ri)
-				if hi != NoHit {
-					// Optical length calculation ends at the planet
-					olE = hi.T
-
-					// Compute contact point in world space
-					cp := ri.Direction.Multiply(hi.T).Add(ri.Origin)
-					uv := si.UV(cp)
-
-					// Shade the point with directional sunlight
-					n := si.Normal(cp)
-					n = si.Transform.MulDirection(n)
-
-					// Some temporary lighting from the sun (this needs to be tweaked)
-					l := math.Max(0, -n.Dot(SunlightDir)) * SunlightIntensity
-
-					// Apply sunlight amount to earth albedo texture
-					c = sampleTexture(tex, uv.X, uv.Y)
-					c = c.MultiplyRGB(l)
-				} else {
-					// Did not hit planet, compute where it hits outer atmosphere
-					ho2 := so.Intersect(ri)
-					if ho2 != NoHit {
-						olE = ho2.T
-					}
-					// If it did not hit then the first ray grazed the atmosphere and we take the end
-					// point to be the same as the start point, 0
-				}
-
-				// Compute optical length along the ray
-				// Using https://developer.nvidia.com/gpugems/GPUGems2/gpugems2_chapter16.html as a guide
-				optLengthFn := func(ray Ray) func(t, dx float64) float64 {
-					return func(t, _ float64) float64 {
-						p := ray.Direction.Multiply(t).Add(ray.Origin)
-						h := (p.Sub(si.Origin).Length() - si.Radius) / (so.Radius - si.Radius)
-						return math.Exp(-h / RayleighDensityScale)
-					}
-				}
-
-				// First attempt at computing in-scattering term
-				inScatterFn := func(t, dx float64) Vector3 {
-					p := ri.Direction.Multiply(t).Add(ri.Origin)
-
-					// First off, is this point in the shadow of the planet?
-					rshd := Ray{p, Vector3{-SunlightDir.X, -SunlightDir.Y, -SunlightDir.Z}}
-					rshdHit := si.Intersect(rshd)
-					if rshdHit != NoHit {
-						// Yes, no contributions (for now)
-						if debugIntersect {
-							fmt.Printf("In shadow of planet\n")
-						}
-					} else {
-						// Fire a ray from p towards the sun, see how far to the outer atmosphere
-						rs := Ray{p, Vector3{-SunlightDir.X, -SunlightDir.Y, -SunlightDir.Z}}
-						rsHit := so.Intersect(rs)
-						if rsHit != NoHit {
-							// Compute optical length along the sunlight ray from p to the edge of the atmosphere
-							sunOptLength := numIntegrate(optLengthFn(rs), 0, rsHit.T, 5)
-
-							// Determine how much sunlight reaches the point. It gets attenuated as it
-							// passes through the atmosphere. To keep things simple We ignore in scattering
-							// events along this path.
-							fudge := 1e-5 // TODO - Can I eliminate this?
-							sunColor := Vector3{
-								SunlightIntensity * math.Exp(-RayleighExtinction.R*sunOptLength) * fudge,
-								SunlightIntensity * math.Exp(-RayleighExtinction.G*sunOptLength) * fudge,
-								SunlightIntensity * math.Exp(-RayleighExtinction.B*sunOptLength) * fudge,
-							}
-
-							// Compute contribution of sunlight to path
-							cosT := r.Direction.Dot(SunlightDir)
-							scatPhase := (3 / (16.0 * math.Pi)) * (cosT*cosT + 1)
-							contrib := sunColor.Multiply(scatPhase)
-
-							// It undergoes extinction on the path segment
-							// My intuition is to use the step size between integration samples as the distance
-							// travelled because we are accumulating in-scattering events along the entire path.
-							// TODO - verify
-							return Vector3{
-								contrib.X * math.Exp(-RayleighExtinction.R*dx),
-								contrib.Y * math.Exp(-RayleighExtinction.G*dx),
-								contrib.Z * math.Exp(-RayleighExtinction.B*dx),
-							}
-						} else {
-							// Calling out an exceptional case - this should never be reached
-							// TODO: we are getting here, this needs to be debugged
-							// fmt.Printf("What am I doing here?\n")
-						}
-					}
-					return Vector3{}
-				}
-				inScatter := numIntegrateV(inScatterFn, 0, olE, 50)
-				inScatterCol := Color{inScatter.X, inScatter.Y, inScatter.Z, 1}
-
-				// Final color = planet color * Fex + Fin
-				// TODO - include Fex term
-				c = c.AddRGB(inScatterCol)
-			}
-			img.Set(x, y, c.Pack())
+	renderAnimation(scene, *animFrames, animAxis, *out, func(path string) {
+		if *format == "hdr" {
+			writeHDR(path, scene.Width, scene.Height, scene.RenderHDR())
+			return
+		}
+		var img *image.RGBA
+		if *tile > 0 {
+			img = scene.RenderTiled(*tile, func(done, total int) {
+				fmt.Printf("\rRendered %d/%d tiles", done, total)
+			})
+			fmt.Printf("\n")
+		} else {
+			img = scene.Render()
+		}
+		if *format == "jpeg" {
+			writeJPEG(path, img, *quality)
+			return
+		}
+		writePNG(path, img)
+	})
+	if scene.TransmittanceCutoff > 0 {
+		fmt.Printf("Skipped %d in-scattering samples below the transmittance cutoff\n", scene.SkippedSamples())
+	}
+}
+
+// Render n frames of the sun turning a full circle about axis, frame i has the sun
+// direction rotated by 2pi*i/n. write renders the scene to the path it is given. A
+// single frame is written to out, otherwise the frame number is added to the name
+// so out.png becomes out_000.png, out_001.png and so on.
+func renderAnimation(s *Scene, n int, axis Vector3, out string, write func(path string)) {
+	if n == 1 {
+		write(out)
+		return
+	}
+
+	sun, disk := s.Sun.Direction, s.SunDisk
+	defer func() { s.Sun.Direction, s.SunDisk = sun, disk }()
+	ext := filepath.Ext(out)
+	for i := 0; i < n; i++ {
+		s.Sun.Direction = sun.RotateAround(axis, 2*math.Pi*float64(i)/float64(n))
+		if disk != nil {
+			s.SunDisk = NewSunDisk(s.Planet.Center(), s.Sun.Direction)
 		}
+		write(fmt.Sprintf("%s_%03d%s", strings.TrimSuffix(out, ext), i, ext))
 	}
-	of, err := os.Create("./out.png")
+}
+
+func loadPNG(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+func writePNG(path string, img image.Image) {
+	of, err := os.Create(path)
 	if err != nil {
 		fmt.Printf("Could not create output file: %v", err)
 		return
@@ -362,3 +938,34 @@ func main() {
 		return
 	}
 }
+
+func writeJPEG(path string, img image.Image, quality int) {
+	of, err := os.Create(path)
+	if err != nil {
+		fmt.Printf("Could not create output file: %v", err)
+		return
+	}
+	defer of.Close()
+	err = jpeg.Encode(of, img, &jpeg.Options{Quality: quality})
+	if err != nil {
+		fmt.Printf("Encode JPEG failed %v", err)
+		return
+	}
+}
+
+// Start writing a CPU profile to path, the returned function stops profiling and
+// closes the file
+func startCPUProfile(path string) (func(), error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		pprof.StopCPUProfile()
+		f.Close()
+	}, nil
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
 	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
-const minNormal = 2.2250738585072014E-308 // Smallest positive normal value of type float64
-
 func TestIntegrator(t *testing.T) {
 	fn := func(t, _ float64) float64 {
 		return math.Exp(-(t * t * t * t))
@@ -17,16 +24,726 @@ func TestIntegrator(t *testing.T) {
 	}
 }
 
-// Returns true if two floating point numbers are within epsilon of each other
-func nearlyEqual(a, b, epsilon float64) bool {
-	diff := math.Abs(a - b)
+func TestIntegratorSimpson(t *testing.T) {
+	quartic := func(t, _ float64) float64 {
+		return math.Exp(-(t * t * t * t))
+	}
+	res := numIntegrateSimpson(quartic, -2, 2, 1001)
+	if !nearlyEqual(res, 1.81280494737, 0.00000001) {
+		t.Errorf("Expected %v got %v", 1.81280494737, res)
+	}
+
+	// The integrand is nearly flat at both ends which suits the trapezoidal rule,
+	// Simpson's rule only pulls ahead once the peak is well sampled
+	for _, n := range []int{33, 65, 129} {
+		want := 1.8128049473761914
+		trap := math.Abs(numIntegrate(quartic, -2, 2, n) - want)
+		simp := math.Abs(numIntegrateSimpson(quartic, -2, 2, n) - want)
+		if simp >= trap {
+			t.Errorf("n=%v: expected Simpson error %v to be below trapezoidal %v", n, simp, trap)
+		}
+	}
+
+	// Exponential density falloff like the atmosphere, odd and even step counts.
+	// The latter finish with the 3/8 rule.
+	falloff := func(t, _ float64) float64 {
+		return math.Exp(-t)
+	}
+	want := 1 - math.Exp(-4)
+	for _, n := range []int{5, 6, 9, 10} {
+		trap := math.Abs(numIntegrate(falloff, 0, 4, n) - want)
+		simp := math.Abs(numIntegrateSimpson(falloff, 0, 4, n) - want)
+		if simp >= trap/10 {
+			t.Errorf("n=%v: expected Simpson error %v to be well below trapezoidal %v", n, simp, trap)
+		}
+	}
+}
+
+func TestIntegratorVKahan(t *testing.T) {
+	// A long path of many tiny, inexactly represented contributions. The running
+	// total grows far larger than each step so plain summation rounds every add.
+	fn := func(_, _ float64) Vector3 {
+		return Vector3{0.1, 0.01, 0.001}
+	}
+	const n = 1000001
+	want := Vector3{0.1, 0.01, 0.001}.Multiply(4000)
+
+	naive := numIntegrateV(fn, 0, 4000, n)
+	kahan := numIntegrateVKahan(fn, 0, 4000, n)
+	if naive.DistanceTo(want) < 1e-10 {
+		t.Fatalf("Expected plain summation to drift, got %v", naive)
+	}
+	if d := kahan.DistanceTo(want); d > 1e-12 {
+		t.Errorf("Expected %v got %v, off by %v", want, kahan, d)
+	}
+	if kahan.DistanceTo(want) >= naive.DistanceTo(want) {
+		t.Errorf("Expected Kahan %v to be closer to %v than plain summation %v", kahan, want, naive)
+	}
+}
+
+func TestIntegratorVAdaptive(t *testing.T) {
+	// Smooth but front loaded, like the density along a ray leaving the ground
+	fn := func(x, _ float64) Vector3 {
+		return Vector3{math.Exp(-x), math.Exp(-4 * x), math.Exp(-x) * math.Cos(x)}
+	}
+	const tol = 1e-7
+	const n = 200001
+	want := numIntegrateV(fn, 0, 8, n)
+
+	res, evals := numIntegrateVAdaptive(fn, 0, 8, tol)
+	if d := res.Sub(want).Abs(); d.X > tol || d.Y > tol || d.Z > tol {
+		t.Errorf("Expected %v got %v", want, res)
+	}
+	if evals >= n/10 {
+		t.Errorf("Expected far fewer than %v evaluations, got %v", n, evals)
+	}
+}
+
+func TestRayAt(t *testing.T) {
+	r := Ray{Vector3{1, 2, 3}, Vector3{0.5, -1, 2}}
+	if got := r.At(0); got != r.Origin {
+		t.Errorf("Expected At(0) to be the origin %v, got %v", r.Origin, got)
+	}
+	if got, want := r.At(1), r.Origin.Add(r.Direction); got != want {
+		t.Errorf("Expected At(1) to be %v, got %v", want, got)
+	}
+}
+
+func TestColorPack(t *testing.T) {
+	tests := []struct {
+		in   Color
+		want color.NRGBA
+	}{
+		{Color{0, 0, 0, 0}, color.NRGBA{0, 0, 0, 0}},
+		{Color{1, 1, 1, 1}, color.NRGBA{255, 255, 255, 255}},
+		{Color{0.5, 0.25, 0.75, 0.5}, color.NRGBA{127, 63, 191, 127}},
+		{Color{1.5, 2, 100, 3}, color.NRGBA{255, 255, 255, 255}},
+		{Color{-0.5, -1, -100, -2}, color.NRGBA{0, 0, 0, 0}},
+		{Color{-1, 0.5, 2, 1}, color.NRGBA{0, 127, 255, 255}},
+	}
+
+	for _, tt := range tests {
+		if got := tt.in.Pack(); got != tt.want {
+			t.Errorf("%v.Pack() = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSphereAltitudeTranslated(t *testing.T) {
+	center := Vector3{2 * EarthRadius, -EarthRadius, 0}
+	s := Sphere{Vector3{0, 0, 0}, EarthRadius, Translate(center).Mul(Rotate(Vector3{0, 1, 0}, -0.5))}
+
+	origin := Vector3{0, 0, -40 * 1000 * 1000}
+	r := Ray{origin, center.Sub(origin).Normalize()}
+	h := s.Intersect(r)
+	if h == NoHit {
+		t.Fatalf("Expected ray towards translated sphere to hit")
+	}
+	p := r.At(h.T)
+	if alt := s.Altitude(p); math.Abs(alt) > 1e-3 {
+		t.Errorf("Expected surface altitude ~0, got %v", alt)
+	}
+	if alt := s.Altitude(center); !nearlyEqual(alt, -EarthRadius, 1e-9) {
+		t.Errorf("Expected altitude of center to be %v, got %v", -EarthRadius, alt)
+	}
+}
+
+func TestColorSubDivide(t *testing.T) {
+	a, b := Color{1, 0.5, 0.25, 1}, Color{0.5, 1, 0.25, 0.5}
+	if got, want := a.SubRGB(b), (Color{0.5, -0.5, 0, 1}); got != want {
+		t.Errorf("Expected %v got %v", want, got)
+	}
+	if got, want := a.DivideRGB(4), (Color{0.25, 0.125, 0.0625, 1}); got != want {
+		t.Errorf("Expected %v got %v", want, got)
+	}
+}
+
+func TestColorIsBlack(t *testing.T) {
+	if !(Color{0, 0, 0, 1}).IsBlack() || !(Color{0, 0, 0, 0}).IsBlack() {
+		t.Errorf("Expected black regardless of alpha")
+	}
+	if (Color{0, 0, 1e-300, 1}).IsBlack() {
+		t.Errorf("Expected a tiny blue channel not to be black")
+	}
+}
+
+func TestColorMultiplyColor(t *testing.T) {
+	got := Color{0.5, 0.5, 0.5, 1}.MultiplyColor(Color{0.2, 0.4, 0.6, 0.5})
+	want := Color{0.1, 0.2, 0.3, 1}
+	if got != want {
+		t.Errorf("Expected %v got %v", want, got)
+	}
+}
+
+func TestTonemap(t *testing.T) {
+	for name, op := range map[string]func(Color) Color{
+		"reinhard": Color.TonemapReinhard,
+		"aces":     Color.TonemapACES,
+	} {
+		if got := op(Color{0, 0, 0, 1}); got != (Color{0, 0, 0, 1}) {
+			t.Errorf("%s: expected black to map to black, got %v", name, got)
+		}
+		prev := -1.0
+		for x := 0.0; x <= 20; x += 0.125 {
+			got := op(Color{x, x, x, 1}).R
+			if got < prev {
+				t.Errorf("%s: not monotonic at %v, %v < %v", name, x, got, prev)
+			}
+			prev = got
+		}
+	}
+
+	for _, x := range []float64{1, 10, 1000, 1e9} {
+		c := Color{x, x / 2, x * 2, 1}.TonemapACES()
+		for _, v := range []float64{c.R, c.G, c.B} {
+			if v < 0 || v > 1 {
+				t.Errorf("Expected ACES output of %v in [0,1], got %v", x, c)
+			}
+		}
+	}
+}
+
+func TestGammaEncode(t *testing.T) {
+	c := Color{0.2, 0.5, 0.8, 0.5}
+	if got := c.GammaEncode(1); got != c {
+		t.Errorf("Expected gamma 1 to be a no-op, got %v", got)
+	}
+	got := c.GammaEncode(2.2)
+	if got.G <= c.G || got.A != c.A {
+		t.Errorf("Expected gamma 2.2 to brighten mid-tones and keep alpha, got %v", got)
+	}
+	if got := (Color{-1e-9, 0, 1, 1}).GammaEncode(2.2); got != (Color{0, 0, 1, 1}) {
+		t.Errorf("Expected negative channels to clamp to 0, got %v", got)
+	}
+}
+
+func TestColorSanitize(t *testing.T) {
+	c := Color{math.NaN(), math.Inf(1), 0.5, math.Inf(-1)}
+	if got, want := c.Sanitize(), (Color{0, 0, 0.5, 0}); got != want {
+		t.Errorf("Expected %v got %v", want, got)
+	}
+	if c := (Color{0.1, -2, 3, 1}); c.Sanitize() != c {
+		t.Errorf("Expected finite color %v to be unchanged, got %v", c, c.Sanitize())
+	}
+
+	pix := []Color{{1, 1, 1, 1}, {math.NaN(), 0, 0, 1}, {0, 0, math.Inf(1), 1}}
+	if n := sanitizePixels(pix); n != 2 {
+		t.Errorf("Expected 2 sanitized pixels, got %v", n)
+	}
+	if pix[1] != (Color{0, 0, 0, 1}) || pix[2] != (Color{0, 0, 0, 1}) {
+		t.Errorf("Expected sanitized pixels, got %v", pix)
+	}
+}
+
+func TestColorLerp(t *testing.T) {
+	a, b := Color{0, 0.2, 1, 1}, Color{1, 0.6, 0, 0}
+	if got, want := a.Lerp(b, 0.5), (Color{0.5, 0.4, 0.5, 0.5}); got != want {
+		t.Errorf("Expected %v got %v", want, got)
+	}
+	if got := a.Lerp(b, 0); got != a {
+		t.Errorf("Expected %v got %v", a, got)
+	}
+}
+
+func TestColorClamp01(t *testing.T) {
+	got := Color{-0.5, 0.25, 3, 2}.Clamp01()
+	if want := (Color{0, 0.25, 1, 2}); got != want {
+		t.Errorf("Expected %v got %v", want, got)
+	}
+}
+
+func TestColorCompositeOver(t *testing.T) {
+	fg := Color{1, 0, 0, 0.5}.Premultiply()
+	bg := Color{0, 0, 1, 1}.Premultiply()
+	got := fg.CompositeOver(bg)
+	want := Color{0.5, 0, 0.5, 1}
+	if got != want {
+		t.Errorf("Expected %v got %v", want, got)
+	}
+
+	// Compositing over a transparent background leaves the layer unchanged
+	if got := fg.CompositeOver(Color{}); got != fg {
+		t.Errorf("Expected %v got %v", fg, got)
+	}
+}
+
+func TestColorPremultiplyRoundTrip(t *testing.T) {
+	for _, c := range []Color{
+		{0.2, 0.4, 0.6, 0.5},
+		{1, 1, 1, 1},
+		{0.3, 0.9, 0.1, 0.25},
+	} {
+		got := c.Premultiply().Unpremultiply()
+		if !nearlyEqual(got.R, c.R, 1e-12) || !nearlyEqual(got.G, c.G, 1e-12) ||
+			!nearlyEqual(got.B, c.B, 1e-12) || got.A != c.A {
+			t.Errorf("Expected %v got %v", c, got)
+		}
+	}
+
+	if got := (Color{0.5, 0.5, 0.5, 0}).Unpremultiply(); got != (Color{}) {
+		t.Errorf("Expected transparent black for zero alpha, got %v", got)
+	}
+}
+
+func TestColorVector3RoundTrip(t *testing.T) {
+	c := Color{0.1, 0.2, 0.3, 0.5}
+	if got, want := c.ToVector3().ToColor(), (Color{0.1, 0.2, 0.3, 1}); got != want {
+		t.Errorf("Expected %v got %v", want, got)
+	}
+	v := Vector3{1.5, -2, 0.25}
+	if got := v.ToColor().ToVector3(); got != v {
+		t.Errorf("Expected %v got %v", v, got)
+	}
+}
+
+func TestSphereTangent(t *testing.T) {
+	s := Sphere{Vector3{0, 0, 0}, 2, Translate(Vector3{1, -3, 5}).Mul(Rotate(Vector3{1, 1, 0}, 0.7))}
+	for _, d := range []Vector3{{0.3, 0.8, -0.5}, {-1, 0.2, 0.3}, {0, 1, 0}} {
+		wp := s.Transform.MulPosition(d.Normalize().Multiply(2))
+		tangent, bitangent := s.Tangent(wp)
+		n := s.Normal(wp)
+		if math.Abs(tangent.Dot(bitangent)) > 1e-12 || math.Abs(tangent.Dot(n)) > 1e-12 || math.Abs(bitangent.Dot(n)) > 1e-12 {
+			t.Errorf("%v: expected an orthogonal frame, got tangent %v bitangent %v normal %v", d, tangent, bitangent, n)
+		}
+		if !nearlyEqual(tangent.Length(), 1, 1e-12) || !nearlyEqual(bitangent.Length(), 1, 1e-12) {
+			t.Errorf("%v: expected unit tangent %v and bitangent %v", d, tangent, bitangent)
+		}
+		if d.Y == 1 {
+			// u is undefined at the pole
+			continue
+		}
+
+		// Stepping along the frame moves along u and v respectively
+		uv := s.UV(wp)
+		du := s.UV(wp.Add(tangent.Multiply(1e-4))).Sub(uv)
+		dv := s.UV(wp.Add(bitangent.Multiply(1e-4))).Sub(uv)
+		if du.X <= 0 || math.Abs(du.Y) > 1e-6 {
+			t.Errorf("%v: expected the tangent to increase u only, got %v", d, du)
+		}
+		if dv.Y <= 0 || math.Abs(dv.X) > 1e-6 {
+			t.Errorf("%v: expected the bitangent to increase v only, got %v", d, dv)
+		}
+	}
+}
+
+func TestSphereNormalScaled(t *testing.T) {
+	// Stretched along X into the ellipsoid x^2/4 + y^2 + z^2 = 1
+	s := Sphere{Vector3{0, 0, 0}, 1, Translate(Vector3{0, 5, 0}).Mul(Scale(Vector3{2, 1, 1}))}
+	wp := Vector3{math.Sqrt2, 5 + math.Sqrt(0.5), 0}
+	want := Vector3{1, 2, 0}.Normalize()
+	if got := s.Normal(wp); got.DistanceTo(want) > 1e-12 {
+		t.Errorf("Expected normal %v got %v", want, got)
+	}
+}
+
+func TestSphereContains(t *testing.T) {
+	si := Sphere{Vector3{0, 0, 0}, EarthRadius, Translate(PlanetCenter).Mul(Rotate(Vector3{0, 1, 0}, -0.5))}
+
+	tests := []struct {
+		p    Vector3
+		want bool
+	}{
+		{Vector3{0, 0, 0}, true},
+		{Vector3{0, 0, -EarthRadius + 1}, true},
+		{Vector3{0, 0, -EarthRadius - 1}, false},
+		{Vector3{0, 0, -40 * 1000 * 1000}, false},
+	}
+	for _, tt := range tests {
+		if got := si.Contains(tt.p); got != tt.want {
+			t.Errorf("Contains(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+		if alt := si.Altitude(tt.p); math.IsNaN(alt) || math.IsInf(alt, 0) {
+			t.Errorf("Altitude(%v) is not finite: %v", tt.p, alt)
+		}
+	}
+}
+
+func TestSphereIntersectFromInside(t *testing.T) {
+	s := Sphere{Vector3{0, 0, 0}, EarthRadius + EarthAtmosphereHeight, Translate(Vector3{1000, -2000, 3000})}
+	center := s.Center()
+	rng := rand.New(rand.NewSource(1))
+	randomDir := func() Vector3 {
+		for {
+			v := Vector3{rng.Float64()*2 - 1, rng.Float64()*2 - 1, rng.Float64()*2 - 1}
+			if l := v.Length(); l > 1e-3 && l <= 1 {
+				return v.Normalize()
+			}
+		}
+	}
+
+	for i := 0; i < 10000; i++ {
+		// Depths below the surface from 1 micron to the full radius, biased towards the
+		// surface where the exit distance is smallest
+		depth := math.Pow(10, -6+rng.Float64()*13)
+		if depth >= s.Radius {
+			depth = s.Radius * rng.Float64()
+		}
+		p := center.Add(randomDir().Multiply(s.Radius - depth))
+		r := Ray{p, randomDir()}
+		if h := s.Intersect(r); h == NoHit || h.T <= 0 {
+			t.Fatalf("Expected ray from %v (%vm deep) in direction %v to exit the sphere, got %v", p, depth, r.Direction, h)
+		}
+	}
+}
+
+func TestFaceForwardFromInside(t *testing.T) {
+	s := Sphere{Vector3{0, 0, 0}, EarthRadius + EarthAtmosphereHeight, Identity()}
+
+	// Ray from inside the sphere hits it from the inside
+	r := Ray{Vector3{0, EarthRadius, 0}, Vector3{1, 0, 0}}
+	h := s.Intersect(r)
+	if h == NoHit {
+		t.Fatalf("Expected ray to hit the sphere")
+	}
+	p := r.At(h.T)
+	outward := s.Normal(p)
+	n := faceForward(outward, r.Direction)
+	if !n.NearlyEqual(outward.Multiply(-1), 1e-12) {
+		t.Errorf("Expected inward normal %v got %v", outward.Multiply(-1), n)
+	}
+	if n.Dot(p) >= 0 {
+		t.Errorf("Expected normal %v to point towards the center", n)
+	}
+
+	// From outside the normal is left alone
+	r = Ray{Vector3{-2 * EarthRadius, 0, 0}, Vector3{1, 0, 0}}
+	p = r.At(s.Intersect(r).T)
+	if n := faceForward(s.Normal(p), r.Direction); n != s.Normal(p) {
+		t.Errorf("Expected outward normal %v got %v", s.Normal(p), n)
+	}
+}
+
+func TestSphereDegenerateTransform(t *testing.T) {
+	s := Sphere{Vector3{0, 0, 0}, 1, Scale(Vector3{1, 0, 1})}
+	r := Ray{Vector3{0, 0, -5}, Vector3{0, 0, 1}}
+	if h := s.Intersect(r); h != NoHit {
+		t.Errorf("Expected a degenerate sphere to be missed, got %v", h)
+	}
+	if s.Occludes(r) {
+		t.Errorf("Expected a degenerate sphere not to occlude")
+	}
+}
+
+func TestScaledShapeHitDistance(t *testing.T) {
+	// Unit shapes scaled by 2, the hit distances are measured in world space
+	scale := Scale(Vector3{2, 2, 2})
+	r := Ray{Vector3{0, 0, -10}, Vector3{0, 0, 1}}
+	for _, tt := range []struct {
+		shape Shape
+		want  float64
+	}{
+		{Sphere{Vector3{}, 1, scale}, 8},
+		{Plane{Vector3{0, 0, 1}, Vector3{0, 0, -1}, scale}, 12},
+		{Disk{Vector3{0, 0, 1}, Vector3{0, 0, -1}, 1, scale}, 12},
+		{Triangle{V0: Vector3{-1, -1, 1}, V1: Vector3{1, -1, 1}, V2: Vector3{0, 1, 1}, Transform: scale}, 12},
+	} {
+		h := tt.shape.Intersect(r)
+		if !nearlyEqual(h.T, tt.want, 1e-12) {
+			t.Errorf("%T: expected hit at %v got %v", tt.shape, tt.want, h.T)
+		}
+		if p, want := r.At(h.T), (Vector3{0, 0, -10 + tt.want}); !p.NearlyEqual(want, 1e-12) {
+			t.Errorf("%T: expected hit point %v got %v", tt.shape, want, p)
+		}
+	}
+}
+
+func TestClosestHit(t *testing.T) {
+	near := Sphere{Vector3{0, 0, 10}, 3, Identity()}
+	middle := Sphere{Vector3{0, 0, 12}, 4, Identity()}
+	far := Sphere{Vector3{0, 0, 15}, 5, Identity()}
+	r := Ray{Vector3{0, 0, 0}, Vector3{0, 0, 1}}
+
+	// Order of the shapes does not matter
+	for _, shapes := range [][]Shape{{near, middle, far}, {far, middle, near}, {middle, far, near}} {
+		h := closestHit(r, shapes)
+		if h.Shape != Shape(near) || !nearlyEqual(h.T, 7, 1e-12) {
+			t.Errorf("Expected nearest sphere at t=7, got %v", h)
+		}
+	}
+
+	if h := closestHit(Ray{Vector3{0, 0, 0}, Vector3{0, 1, 0}}, []Shape{near, middle, far}); h != NoHit {
+		t.Errorf("Expected miss, got %v", h)
+	}
+	if h := closestHit(r, nil); h != NoHit {
+		t.Errorf("Expected miss with no shapes, got %v", h)
+	}
+}
+
+func TestSphereOccludes(t *testing.T) {
+	si := Sphere{Vector3{0, 0, 0}, EarthRadius, Translate(PlanetCenter).Mul(Rotate(Vector3{0, 1, 0}, -0.5))}
+	origin := Vector3{0, 0, -40 * 1000 * 1000}
+
+	tests := []struct {
+		name string
+		r    Ray
+		want bool
+	}{
+		{"at center", Ray{origin, Vector3{0, 0, 1}}, true},
+		{"away from center", Ray{origin, Vector3{0, 0, -1}}, false},
+		{"passes beside", Ray{origin, Vector3{0, 2 * EarthRadius, 40 * 1000 * 1000}.Normalize()}, false},
+		{"starts inside", Ray{Vector3{0, 0, 1000}, Vector3{0, 1, 0}}, true},
+	}
+	for _, tt := range tests {
+		if got := si.Occludes(tt.r); got != tt.want {
+			t.Errorf("%s: Occludes = %v, want %v", tt.name, got, tt.want)
+		}
+		if got := si.Intersect(tt.r) != NoHit; got != tt.want {
+			t.Errorf("%s: Intersect hit = %v, disagrees with Occludes", tt.name, got)
+		}
+	}
+
+	// Stretched along X, rays beside the unit sphere but inside the ellipsoid
+	e := Sphere{Vector3{0, 0, 0}, 1, Translate(Vector3{0, 0, 5}).Mul(Scale(Vector3{2, 1, 1}))}
+	for _, r := range []Ray{
+		{Vector3{1.5, 0, -10}, Vector3{0, 0, 1}},
+		{Vector3{0, 1.5, -10}, Vector3{0, 0, 1}},
+		{Vector3{-10, 0.9, 5}, Vector3{1, 0, 0}},
+		{Vector3{-10, 0, -10}, Vector3{1.9, 0, 1.5}.Normalize()},
+	} {
+		if got, want := e.Occludes(r), e.Intersect(r) != NoHit; got != want {
+			t.Errorf("Scaled sphere %v: Occludes = %v, Intersect hit = %v", r, got, want)
+		}
+	}
+}
+
+func TestAddInScatterTint(t *testing.T) {
+	surface := Color{0.2, 0.3, 0.4, 1}
+	inScatter := Color{0.1, 0.2, 0.3, 1}
+
+	got := addInScatter(surface, inScatter, Color{1, 1, 1, 1})
+	if want := surface.AddRGB(inScatter); got != want {
+		t.Errorf("White tint: expected %v got %v", want, got)
+	}
+
+	got = addInScatter(surface, inScatter, Color{1, 0, 0, 1})
+	if want := (Color{surface.R + inScatter.R, surface.G, surface.B, surface.A}); got != want {
+		t.Errorf("Red tint: expected %v got %v", want, got)
+	}
+}
+
+func TestSceneAtmosphereTint(t *testing.T) {
+	scene := NewScene(testTexture())
+	// Lit planet surface seen through the atmosphere
+	r := scene.Camera.RayFor(320, 200, scene.Width, scene.Height)
+	white := scene.shadeRay(r, nil)
+	scene.AtmosphereTint = Color{0, 0, 0, 1}
+	surface := scene.shadeRay(r, nil)
+	scene.AtmosphereTint = Color{1, 0, 0, 1}
+	red := scene.shadeRay(r, nil)
+
+	if surface.G <= 0 || white.G <= surface.G {
+		t.Fatalf("Expected a lit surface %v with light scattered in front of it %v", surface, white)
+	}
+	// Only the in-scattered red is kept, the attenuated surface color is untouched
+	if red.G != surface.G || red.B != surface.B {
+		t.Errorf("Expected the red tint to leave the surface green and blue at %v, got %v", surface, red)
+	}
+	if !nearlyEqual(red.R, white.R, 1e-12) {
+		t.Errorf("Expected the red tint to keep all the red light %v, got %v", white.R, red.R)
+	}
+}
+
+func TestParseRGB(t *testing.T) {
+	c, err := parseRGB("1, 0.5,0")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if want := (Color{1, 0.5, 0, 1}); c != want {
+		t.Errorf("Expected %v got %v", want, c)
+	}
+
+	for _, s := range []string{"", "1,2", "1,2,3,4", "1,x,3"} {
+		if _, err := parseRGB(s); err == nil {
+			t.Errorf("Expected error parsing %q", s)
+		}
+	}
+}
 
-	if a == b {
-		return true
-	} else if a == 0 || b == 0 || diff < minNormal {
-		return diff < (epsilon * minNormal)
-	} else {
-		absA, absB := math.Abs(a), math.Abs(b)
-		return diff/math.Min((absA+absB), math.MaxFloat64) < epsilon
+func TestParseVector3(t *testing.T) {
+	v, err := parseVector3("0,-1, 2.5")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if want := (Vector3{0, -1, 2.5}); v != want {
+		t.Errorf("Expected %v got %v", want, v)
+	}
+	if _, err := parseVector3("1,2"); err == nil || !strings.Contains(err.Error(), "x,y,z") {
+		t.Errorf("Expected an x,y,z error, got %v", err)
+	}
+}
+
+func TestRenderAnimation(t *testing.T) {
+	scene := NewScene(testTexture())
+	scene.Width, scene.Height = 32, 24
+	dir := t.TempDir()
+	write := func(path string) { writePNG(path, scene.Render()) }
+
+	// A single frame is today's output
+	writePNG(filepath.Join(dir, "want.png"), scene.Render())
+	renderAnimation(scene, 1, Vector3{0, 1, 0}, filepath.Join(dir, "out.png"), write)
+	want, err := os.ReadFile(filepath.Join(dir, "want.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "out.png"))
+	if err != nil {
+		t.Fatalf("Expected out.png: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Expected a single frame to match the plain render")
+	}
+
+	sun := scene.Sun.Direction
+	renderAnimation(scene, 4, Vector3{0, 1, 0}, filepath.Join(dir, "anim.png"), write)
+	if scene.Sun.Direction != sun {
+		t.Errorf("Expected the sun direction to be restored, got %v instead of %v", scene.Sun.Direction, sun)
+	}
+	frames := make([][]byte, 4)
+	for i := range frames {
+		path := filepath.Join(dir, fmt.Sprintf("anim_%03d.png", i))
+		if frames[i], err = os.ReadFile(path); err != nil {
+			t.Fatalf("Expected frame %v: %v", path, err)
+		}
+		for j := 0; j < i; j++ {
+			if bytes.Equal(frames[i], frames[j]) {
+				t.Errorf("Expected frames %d and %d to differ", j, i)
+			}
+		}
+	}
+	if !bytes.Equal(frames[0], want) {
+		t.Errorf("Expected the first frame to have the sun unrotated")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "anim*")); len(files) != 4 {
+		t.Errorf("Expected 4 frames, got %v", files)
+	}
+}
+
+func TestAdvanceRayEarthScale(t *testing.T) {
+	so := Sphere{Vector3{0, 0, 0}, EarthRadius + EarthAtmosphereHeight, Identity()}
+	camera := Vector3{0, 0, -40 * 1000 * 1000}
+
+	for _, target := range []Vector3{
+		{0, 0, 0},
+		{0.5 * EarthRadius, 0.5 * EarthRadius, 0},
+		{0, EarthRadius + 0.99*EarthAtmosphereHeight, 0},
+	} {
+		r := Ray{camera, target.Sub(camera).Normalize()}
+		ho := so.Intersect(r)
+		if ho == NoHit {
+			t.Fatalf("Expected ray towards %v to hit the atmosphere", target)
+		}
+
+		ri := advanceRay(r, ho.T)
+		if !so.Contains(ri.Origin) {
+			t.Errorf("Expected advanced origin %v to be inside the atmosphere", ri.Origin)
+		}
+		// The next hit must be the far side, not the entry point again
+		if exit := so.Intersect(ri); exit == NoHit || exit.T < 1000 {
+			t.Errorf("Expected ray towards %v to exit the far side of the atmosphere, got %v", target, exit.T)
+		}
+	}
+}
+
+func TestMiePhase(t *testing.T) {
+	// Integrating over the sphere, dω = 2π d(cosθ)
+	for _, g := range []float64{0, 0.5, MieG} {
+		fn := func(mu, _ float64) float64 {
+			return 2 * math.Pi * miePhase(mu, g)
+		}
+		if res := numIntegrate(fn, -1, 1, 20000); !nearlyEqual(res, 1, 0.001) {
+			t.Errorf("Expected phase function with g=%v to integrate to 1, got %v", g, res)
+		}
+	}
+
+	// g = 0 is isotropic
+	if p := miePhase(0.3, 0); !nearlyEqual(p, 1/(4*math.Pi), 1e-12) {
+		t.Errorf("Expected isotropic phase %v, got %v", 1/(4*math.Pi), p)
+	}
+	// Positive g favors forward scattering
+	if miePhase(1, MieG) <= miePhase(-1, MieG) {
+		t.Errorf("Expected forward scattering to dominate for g=%v", MieG)
+	}
+}
+
+func TestSampleTextureBilinear(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 1))
+	img.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	img.Set(1, 0, color.RGBA{0, 0, 255, 255})
+	img.Set(2, 0, color.RGBA{0, 255, 0, 255})
+	img.Set(3, 0, color.RGBA{0, 0, 255, 255})
+	red := NewColorFromRGBA(img.At(0, 0).RGBA())
+	blue := NewColorFromRGBA(img.At(1, 0).RGBA())
+
+	near := func(a, b Color) bool {
+		return math.Abs(a.R-b.R) < 1e-9 && math.Abs(a.G-b.G) < 1e-9 && math.Abs(a.B-b.B) < 1e-9 && math.Abs(a.A-b.A) < 1e-9
+	}
+	mid := Color{(red.R + blue.R) / 2, (red.G + blue.G) / 2, (red.B + blue.B) / 2, red.A}
+
+	// On a texel center returns that texel
+	if got := sampleTextureBilinear(img, 0.125, 0.5); !near(got, red) {
+		t.Errorf("Expected %v at the texel center, got %v", red, got)
+	}
+	// Halfway between the first two texel centers
+	if got := sampleTextureBilinear(img, 0.25, 0.5); !near(got, mid) {
+		t.Errorf("Expected midpoint average %v, got %v", mid, got)
+	}
+	// u wraps, at the seam it blends the last and first texels
+	if got := sampleTextureBilinear(img, 0, 0.5); !near(got, mid) {
+		t.Errorf("Expected seam to blend last and first texels %v, got %v", mid, got)
+	}
+	if a, b := sampleTextureBilinear(img, 0.001, 0.5), sampleTextureBilinear(img, 0.999, 0.5); math.Abs(a.R-b.R) > 0.01 {
+		t.Errorf("Expected continuity across the seam, got %v and %v", a, b)
+	}
+
+	if got := FilterNearest.Sample(img, 0.3, 0.5); !near(got, blue) {
+		t.Errorf("Expected nearest filter to return %v, got %v", blue, got)
+	}
+}
+
+func TestStartCPUProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cpu.prof")
+	stop, err := startCPUProfile(path)
+	if err != nil {
+		t.Fatalf("Could not start profile: %v", err)
+	}
+	numIntegrate(func(x, _ float64) float64 { return math.Exp(-x * x) }, 0, 1, 100000)
+	stop()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Expected profile file: %v", err)
+	}
+	if fi.Size() == 0 {
+		t.Errorf("Expected a non-empty profile")
+	}
+
+	if _, err := startCPUProfile(filepath.Join(t.TempDir(), "missing", "cpu.prof")); err == nil {
+		t.Errorf("Expected an error for an uncreatable file")
+	}
+}
+
+func TestWriteJPEG(t *testing.T) {
+	scene := NewScene(nil)
+	scene.Width, scene.Height = 12, 7
+	scene.ToneMapping, scene.Gamma = ToneMapReinhard, 2.2
+	pix := make([]Color, scene.Width*scene.Height)
+	for i := range pix {
+		pix[i] = Color{float64(i) / 10, 0.5, 2, 1}
+	}
+
+	path := filepath.Join(t.TempDir(), "out.jpeg")
+	writeJPEG(path, scene.displayImage(pix), 90)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Expected output file: %v", err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatalf("Could not decode JPEG: %v", err)
+	}
+	if want := image.Rect(0, 0, 12, 7); img.Bounds() != want {
+		t.Errorf("Expected bounds %v got %v", want, img.Bounds())
 	}
 }
@@ -54,6 +54,33 @@ func Rotate(v Vector3, a float64) Matrix {
 		0, 0, 0, 1}
 }
 
+// World to camera transform for a camera at eye looking at center. In camera space
+// the camera is at the origin looking down +Z with +X to the right and +Y up, the
+// same handedness as the world axes and the camera basis used for ray generation.
+func LookAt(eye, center, up Vector3) Matrix {
+	f := center.Sub(eye).Normalize()
+	r := up.Cross(f).Normalize()
+	u := f.Cross(r)
+	return Matrix{
+		r.X, r.Y, r.Z, -r.Dot(eye),
+		u.X, u.Y, u.Z, -u.Dot(eye),
+		f.X, f.Y, f.Z, -f.Dot(eye),
+		0, 0, 0, 1}
+}
+
+// Perspective projection from camera space, where the camera looks down +Z like
+// the world axes, to normalized device coordinates. Points between the near and far
+// planes map to z in [-1, 1] with the near plane at -1, x and y inside the frustum
+// map to [-1, 1]. Use MulProject to apply the perspective divide.
+func Perspective(fovyRadians, aspect, near, far float64) Matrix {
+	f := 1 / math.Tan(fovyRadians/2)
+	return Matrix{
+		f / aspect, 0, 0, 0,
+		0, f, 0, 0,
+		0, 0, (far + near) / (far - near), -2 * far * near / (far - near),
+		0, 0, 1, 0}
+}
+
 func (a Matrix) Mul(b Matrix) Matrix {
 	m := Matrix{}
 	m.x00 = a.x00*b.x00 + a.x01*b.x10 + a.x02*b.x20 + a.x03*b.x30
@@ -82,6 +109,13 @@ func (a Matrix) MulPosition(b Vector3) Vector3 {
 	return Vector3{x, y, z}
 }
 
+// Like MulPosition but uses the bottom row of the matrix and divides by the
+// resulting w, for projection matrices
+func (a Matrix) MulProject(b Vector3) Vector3 {
+	w := a.x30*b.X + a.x31*b.Y + a.x32*b.Z + a.x33
+	return a.MulPosition(b).Divide(w)
+}
+
 func (a Matrix) MulDirection(b Vector3) Vector3 {
 	x := a.x00*b.X + a.x01*b.Y + a.x02*b.Z
 	y := a.x10*b.X + a.x11*b.Y + a.x12*b.Z
@@ -89,10 +123,34 @@ func (a Matrix) MulDirection(b Vector3) Vector3 {
 	return Vector3{x, y, z}.Normalize()
 }
 
+// Transform the ray origin as a position and its direction as a direction. The
+// direction is normalized, so distances along the transformed ray are in the units
+// of the new space. Use TransformRay to keep distances comparable.
 func (a Matrix) MulRay(b Ray) Ray {
 	return Ray{a.MulPosition(b.Origin), a.MulDirection(b.Direction)}
 }
 
+// Multiply every element of the matrix by f
+func (a Matrix) MulScalar(f float64) Matrix {
+	return Matrix{
+		a.x00 * f, a.x01 * f, a.x02 * f, a.x03 * f,
+		a.x10 * f, a.x11 * f, a.x12 * f, a.x13 * f,
+		a.x20 * f, a.x21 * f, a.x22 * f, a.x23 * f,
+		a.x30 * f, a.x31 * f, a.x32 * f, a.x33 * f}
+}
+
+// Transform the ray origin as a position and its direction as a direction without
+// normalizing it. The point at distance t along the transformed ray is the
+// transformed point at t along b, so a t found in one space is valid in the other.
+func (a Matrix) TransformRay(b Ray) Ray {
+	d := Vector3{
+		a.x00*b.Direction.X + a.x01*b.Direction.Y + a.x02*b.Direction.Z,
+		a.x10*b.Direction.X + a.x11*b.Direction.Y + a.x12*b.Direction.Z,
+		a.x20*b.Direction.X + a.x21*b.Direction.Y + a.x22*b.Direction.Z,
+	}
+	return Ray{a.MulPosition(b.Origin), d}
+}
+
 func (a Matrix) Transpose() Matrix {
 	return Matrix{
 		a.x00, a.x10, a.x20, a.x30,
@@ -116,6 +174,34 @@ func (a Matrix) Determinant() float64 {
 		a.x03*a.x12*a.x20*a.x31 + a.x03*a.x12*a.x21*a.x30)
 }
 
+// Whether a only rotates, reflects and translates, so it preserves distances. The
+// rows of the upper 3x3 must be orthonormal to within 1e-9 and there is no
+// projection.
+func (a Matrix) IsRigid() bool {
+	rows := [3]Vector3{{a.x00, a.x01, a.x02}, {a.x10, a.x11, a.x12}, {a.x20, a.x21, a.x22}}
+	for i := range rows {
+		for j := i; j < 3; j++ {
+			want := 0.0
+			if i == j {
+				want = 1
+			}
+			if math.Abs(rows[i].Dot(rows[j])-want) > 1e-9 {
+				return false
+			}
+		}
+	}
+	return a.x30 == 0 && a.x31 == 0 && a.x32 == 0 && a.x33 == 1
+}
+
+// Like Inverse but returns false instead of a matrix full of Inf and NaN when a is
+// singular, e.g. a transform with a zero scale
+func (a Matrix) TryInverse() (Matrix, bool) {
+	if d := a.Determinant(); math.Abs(d) < 1e-30 || math.IsNaN(d) {
+		return Matrix{}, false
+	}
+	return a.Inverse(), true
+}
+
 func (a Matrix) Inverse() Matrix {
 	m := Matrix{}
 	d := a.Determinant()
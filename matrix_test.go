@@ -0,0 +1,207 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTranslate(t *testing.T) {
+	v := Vector3{1, -2, 3}
+	if got := Translate(v).MulPosition(Vector3{}); got != v {
+		t.Errorf("Expected origin to translate to %v, got %v", v, got)
+	}
+	// Directions are unaffected by translation
+	d := Vector3{0, 1, 0}
+	if got := Translate(v).MulDirection(d); got != d {
+		t.Errorf("Expected direction %v to be unchanged, got %v", d, got)
+	}
+}
+
+func TestScale(t *testing.T) {
+	got := Scale(Vector3{2, 3, 4}).MulPosition(Vector3{1, 1, 1})
+	if want := (Vector3{2, 3, 4}); got != want {
+		t.Errorf("Expected %v got %v", want, got)
+	}
+}
+
+func TestMulOrder(t *testing.T) {
+	// Column vector convention, a.Mul(b) applies b first then a
+	p := Vector3{1, 0, 0}
+	ts := Translate(Vector3{10, 0, 0}).Mul(Scale(Vector3{2, 2, 2}))
+	if got, want := ts.MulPosition(p), (Vector3{12, 0, 0}); got != want {
+		t.Errorf("Expected scale then translate to give %v, got %v", want, got)
+	}
+	st := Scale(Vector3{2, 2, 2}).Mul(Translate(Vector3{10, 0, 0}))
+	if got, want := st.MulPosition(p), (Vector3{22, 0, 0}); got != want {
+		t.Errorf("Expected translate then scale to give %v, got %v", want, got)
+	}
+
+	// TRS composition round trips through the inverse
+	m := Translate(Vector3{5, 6, 7}).Mul(Rotate(Vector3{0, 1, 0}, 0.3)).Mul(Scale(Vector3{1, 2, 3}))
+	q := Vector3{-4, 2, 9}
+	got := m.Inverse().MulPosition(m.MulPosition(q))
+	if !nearlyEqual(got.X, q.X, 1e-12) || !nearlyEqual(got.Y, q.Y, 1e-12) || !nearlyEqual(got.Z, q.Z, 1e-12) {
+		t.Errorf("Expected %v got %v", q, got)
+	}
+}
+
+func TestMulIdentityAndTranspose(t *testing.T) {
+	m := Translate(Vector3{1, 2, 3}).Mul(Rotate(Vector3{1, 1, 0}, 0.7)).Mul(Scale(Vector3{2, 3, 4}))
+	if got := Identity().Mul(m); got != m {
+		t.Errorf("Expected Identity().Mul(m) to be m, got %v", got)
+	}
+	if got := m.Mul(Identity()); got != m {
+		t.Errorf("Expected m.Mul(Identity()) to be m, got %v", got)
+	}
+	if got := m.Transpose().Transpose(); got != m {
+		t.Errorf("Expected transposing twice to give m, got %v", got)
+	}
+	if got := m.Transpose(); got.x03 != m.x30 || got.x30 != m.x03 || got.x12 != m.x21 {
+		t.Errorf("Expected rows and columns to be swapped, got %v", got)
+	}
+}
+
+func TestDeterminant(t *testing.T) {
+	if d := Identity().Determinant(); d != 1 {
+		t.Errorf("Expected identity determinant 1, got %v", d)
+	}
+	if d := Scale(Vector3{2, 3, 4}).Determinant(); d != 24 {
+		t.Errorf("Expected scale determinant 24, got %v", d)
+	}
+	// Rotations and translations preserve volume
+	m := Translate(Vector3{1, 2, 3}).Mul(Rotate(Vector3{1, 1, 0}, 0.7)).Mul(Scale(Vector3{2, 3, 4}))
+	if d := m.Determinant(); !nearlyEqual(d, 24, 1e-12) {
+		t.Errorf("Expected TRS determinant 24, got %v", d)
+	}
+	if d := Scale(Vector3{1, 0, 1}).Determinant(); d != 0 {
+		t.Errorf("Expected singular determinant 0, got %v", d)
+	}
+}
+
+func TestMulScalar(t *testing.T) {
+	m := Translate(Vector3{1, 2, 3}).Mul(Scale(Vector3{2, 3, 4}))
+	got := m.MulScalar(2)
+	if got.x00 != 4 || got.x03 != 2 || got.x23 != 6 || got.x33 != 2 || got.x01 != 0 {
+		t.Errorf("Expected every element doubled, got %v", got)
+	}
+	// Scaling a 4x4 matrix by f scales the determinant by f^4
+	if d := got.Determinant(); d != 16*m.Determinant() {
+		t.Errorf("Expected determinant %v got %v", 16*m.Determinant(), d)
+	}
+}
+
+func TestTryInverse(t *testing.T) {
+	m := Translate(Vector3{1, 2, 3}).Mul(Scale(Vector3{2, 3, 4}))
+	inv, ok := m.TryInverse()
+	if !ok || inv != m.Inverse() {
+		t.Errorf("Expected the inverse of an invertible matrix, got %v %v", inv, ok)
+	}
+	if _, ok := Scale(Vector3{1, 0, 1}).TryInverse(); ok {
+		t.Errorf("Expected a singular matrix to have no inverse")
+	}
+}
+
+func TestIsRigid(t *testing.T) {
+	tests := []struct {
+		name string
+		m    Matrix
+		want bool
+	}{
+		{"identity", Identity(), true},
+		{"rotate translate", Translate(Vector3{1, 2, 3}).Mul(Rotate(Vector3{1, 1, 0}, 0.7)), true},
+		{"mirror", Scale(Vector3{-1, 1, 1}), true},
+		{"uniform scale", Scale(Vector3{2, 2, 2}), false},
+		{"non-uniform scale", Rotate(Vector3{0, 1, 0}, 0.3).Mul(Scale(Vector3{1, 1.5, 1})), false},
+		{"projection", Perspective(1, 1, 1, 10), false},
+	}
+	for _, tt := range tests {
+		if got := tt.m.IsRigid(); got != tt.want {
+			t.Errorf("%s: expected %v got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestTransformRay(t *testing.T) {
+	m := Translate(Vector3{1, 2, 3}).Mul(Scale(Vector3{2, 2, 2}))
+	r := Ray{Vector3{1, 0, 0}, Vector3{0, 0, 1}}
+	got := m.TransformRay(r)
+	if want := (Ray{Vector3{3, 2, 3}, Vector3{0, 0, 2}}); got != want {
+		t.Errorf("Expected %v got %v", want, got)
+	}
+	// Points along the ray map to the same t
+	for _, tt := range []float64{0, 1.5, 7} {
+		if p, want := got.At(tt), m.MulPosition(r.At(tt)); !p.NearlyEqual(want, 1e-12) {
+			t.Errorf("t=%v: expected %v got %v", tt, want, p)
+		}
+	}
+	// MulRay normalizes the direction
+	if d := m.MulRay(r).Direction; d != (Vector3{0, 0, 1}) {
+		t.Errorf("Expected a unit direction from MulRay, got %v", d)
+	}
+}
+
+func TestPerspective(t *testing.T) {
+	const fovy, aspect, near, far = math.Pi / 3, 1.5, 2.0, 100.0
+	p := Perspective(fovy, aspect, near, far)
+	near3 := func(v Vector3) bool {
+		return math.Abs(v.X) < 1e-12 && math.Abs(v.Y) < 1e-12 && math.Abs(v.Z) < 1e-12
+	}
+
+	if got := p.MulProject(Vector3{0, 0, near}); !near3(got.Sub(Vector3{0, 0, -1})) {
+		t.Errorf("Expected the near plane to map to z=-1, got %v", got)
+	}
+	if got := p.MulProject(Vector3{0, 0, far}); !near3(got.Sub(Vector3{0, 0, 1})) {
+		t.Errorf("Expected the far plane to map to z=1, got %v", got)
+	}
+
+	// Frustum corners map to the corners of the NDC cube
+	tanHalf := math.Tan(fovy / 2)
+	for _, z := range []float64{near, far} {
+		for _, sx := range []float64{-1, 1} {
+			for _, sy := range []float64{-1, 1} {
+				corner := Vector3{sx * z * tanHalf * aspect, sy * z * tanHalf, z}
+				want := Vector3{sx, sy, -1}
+				if z == far {
+					want.Z = 1
+				}
+				if got := p.MulProject(corner); !near3(got.Sub(want)) {
+					t.Errorf("Expected frustum corner %v to map to %v, got %v", corner, want, got)
+				}
+			}
+		}
+	}
+}
+
+func TestLookAt(t *testing.T) {
+	eye, center, up := Vector3{1000, 2000, -5000}, Vector3{10, -20, 30}, Vector3{0, 1, 0}
+	m := LookAt(eye, center, up)
+
+	if got := m.MulPosition(eye); got.Length() > 1e-9 {
+		t.Errorf("Expected eye to map to the origin, got %v", got)
+	}
+	d := center.Sub(eye).Length()
+	if got := m.MulPosition(center); math.Abs(got.X) > 1e-9 || math.Abs(got.Y) > 1e-9 || !nearlyEqual(got.Z, d, 1e-12) {
+		t.Errorf("Expected center to map to %v on the +Z axis, got %v", d, got)
+	}
+
+	// Combined with Perspective, points along the camera rays through the image
+	// corners land on the corners of NDC
+	c := Camera{Position: eye, LookAt: center, Up: up, FOVDegrees: 50}
+	const width, height = 640, 480
+	p := Perspective(c.FOVDegrees*math.Pi/180, float64(width)/float64(height), 1, 1e5).Mul(m)
+	for _, tt := range []struct {
+		x, y   int
+		sx, sy float64
+	}{
+		{0, 0, -1, 1},
+		{width, 0, 1, 1},
+		{0, height, -1, -1},
+		{width, height, 1, -1},
+		{width / 2, height / 2, 0, 0},
+	} {
+		got := p.MulProject(c.RayFor(tt.x, tt.y, width, height).At(1000))
+		if math.Abs(got.X-tt.sx) > 1e-9 || math.Abs(got.Y-tt.sy) > 1e-9 {
+			t.Errorf("Expected pixel %v,%v to project to %v,%v got %v", tt.x, tt.y, tt.sx, tt.sy, got)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import "math"
+
+// Precomputed optical depth from a point in the atmosphere to its outer edge along
+// the direction to the sun. The atmosphere is spherically symmetric so the depth
+// only depends on the altitude of the point and the cosine of the sun zenith angle.
+// Each altitude row spans the zenith angles from the horizon to straight up,
+// directions below the horizon are blocked by the planet and never looked up.
+// Entries are spaced quadratically in the cosine so they are densest near the
+// horizon, where the depth changes fastest.
+type opticalDepthTable struct {
+	altitudes, angles int
+	height            float64
+	radius            float64
+	// Rayleigh, Mie and ozone optical lengths, indexed by altitude * angles + angle
+	rayleigh, mie, ozone []float64
+}
+
+// Cosine of the zenith angle of the horizon at distance r from the planet center
+func horizonCos(radius, r float64) float64 {
+	return -math.Sqrt(math.Max(0, 1-(radius/r)*(radius/r)))
+}
+
+// Build a table with the given number of altitude and zenith angle entries. Each
+// entry integrates its sun ray with SunSamples samples, like sunDepths without a table.
+func (s *Scene) buildOpticalDepthTable(altitudes, angles int) *opticalDepthTable {
+	so, si := s.Atmosphere, s.Planet
+	center := si.Center()
+	tbl := &opticalDepthTable{
+		altitudes: altitudes,
+		angles:    angles,
+		height:    so.Radius - si.Radius,
+		radius:    si.Radius,
+		rayleigh:  make([]float64, altitudes*angles),
+		mie:       make([]float64, altitudes*angles),
+		ozone:     make([]float64, altitudes*angles),
+	}
+
+	for i := 0; i < altitudes; i++ {
+		r := si.Radius + tbl.height*float64(i)/float64(altitudes-1)
+		muH := horizonCos(si.Radius, r)
+		for j := 0; j < angles; j++ {
+			u := float64(j) / float64(angles-1)
+			mu := muH + (1-muH)*u*u
+			ray := Ray{center.Add(Vector3{0, r, 0}), Vector3{math.Sqrt(math.Max(0, 1-mu*mu)), mu, 0}}
+
+			// Distance to the outer atmosphere along the ray
+			length := -r*mu + math.Sqrt(math.Max(0, r*r*mu*mu-r*r+so.Radius*so.Radius))
+
+			k := i*angles + j
+			tbl.rayleigh[k], tbl.mie[k], tbl.ozone[k] = s.opticalDepths(ray, length, s.SunSamples)
+		}
+	}
+	return tbl
+}
+
+// Rayleigh, Mie and ozone optical lengths at altitude h for the sun zenith angle with
+// cosine mu, bilinearly interpolated from the table
+func (tbl *opticalDepthTable) lookup(h, mu float64) (float64, float64, float64) {
+	fa := clamp(h/tbl.height, 0, 1) * float64(tbl.altitudes-1)
+	i0 := int(fa)
+	if i0 > tbl.altitudes-2 {
+		i0 = tbl.altitudes - 2
+	}
+	ta := fa - float64(i0)
+
+	// Interpolate along the angle within one altitude row. Each row has its own
+	// horizon so the angle index is computed per row.
+	row := func(i int) (float64, float64, float64) {
+		r := tbl.radius + tbl.height*float64(i)/float64(tbl.altitudes-1)
+		muH := horizonCos(tbl.radius, r)
+		fm := math.Sqrt(clamp((mu-muH)/(1-muH), 0, 1)) * float64(tbl.angles-1)
+		j0 := int(fm)
+		if j0 > tbl.angles-2 {
+			j0 = tbl.angles - 2
+		}
+		tm := fm - float64(j0)
+		k := i*tbl.angles + j0
+		return tbl.rayleigh[k]*(1-tm) + tbl.rayleigh[k+1]*tm,
+			tbl.mie[k]*(1-tm) + tbl.mie[k+1]*tm,
+			tbl.ozone[k]*(1-tm) + tbl.ozone[k+1]*tm
+	}
+
+	r0, m0, o0 := row(i0)
+	r1, m1, o1 := row(i0 + 1)
+	return r0*(1-ta) + r1*ta, m0*(1-ta) + m1*ta, o0*(1-ta) + o1*ta
+}
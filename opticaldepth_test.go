@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestOpticalDepthTable(t *testing.T) {
+	scene := NewScene(nil)
+	tbl := scene.buildOpticalDepthTable(64, 64)
+	center := scene.Planet.Center()
+
+	for _, tt := range []struct{ h, zenith float64 }{
+		{0, 0},
+		{1000, 30},
+		{12345, 60},
+		{25000, 85},
+		{60000, 95},
+		{99000, 45},
+	} {
+		mu := math.Cos(tt.zenith * math.Pi / 180)
+		r := Ray{center.Add(Vector3{0, EarthRadius + tt.h, 0}), Vector3{math.Sqrt(1 - mu*mu), mu, 0}}
+		length := scene.Atmosphere.Intersect(r).T
+
+		rayleigh, mie, ozone := tbl.lookup(tt.h, mu)
+		wantRayleigh := numIntegrate(scene.optLengthFn(r), 0, length, scene.SunSamples)
+		wantMie := numIntegrate(func(t, _ float64) float64 {
+			return mieDensity(scene.relativeAltitude(r.At(t)))
+		}, 0, length, scene.SunSamples)
+		wantOzone := numIntegrate(func(t, _ float64) float64 {
+			return scene.ozoneDensity(r.At(t))
+		}, 0, length, scene.SunSamples)
+
+		// Compare the sunlight transmittance the depths produce, the ozone layer has a
+		// sharp peak and its depth interpolates less accurately near the horizon
+		for _, c := range []struct{ rayleigh, mie, ozone float64 }{
+			{RayleighExtinction.R, MieExtinction.R, OzoneAbsorption.R},
+			{RayleighExtinction.G, MieExtinction.G, OzoneAbsorption.G},
+			{RayleighExtinction.B, MieExtinction.B, OzoneAbsorption.B},
+		} {
+			got := math.Exp(-c.rayleigh*rayleigh - c.mie*mie - c.ozone*ozone)
+			want := math.Exp(-c.rayleigh*wantRayleigh - c.mie*wantMie - c.ozone*wantOzone)
+			if math.Abs(got-want) > 0.005 {
+				t.Errorf("h=%v zenith=%v: expected transmittance ~%v got %v", tt.h, tt.zenith, want, got)
+			}
+		}
+	}
+}
+
+func TestOpticalDepthTableSunSamples(t *testing.T) {
+	scene := NewScene(nil)
+	// Low sun seen from the ground, a long path where few samples are inaccurate
+	toSun := scene.Sun.Direction.Multiply(-1)
+	p := scene.Planet.Center().Add(toSun.Cross(Vector3{0, 1, 0}).Normalize().Multiply(EarthRadius + 100))
+	p = p.Add(toSun.Multiply(EarthRadius * 0.1))
+
+	depths := func(n int) float64 {
+		scene.SunSamples = n
+		scene.depthTable = scene.buildOpticalDepthTable(64, 64)
+		rayleigh, _, _, lit := scene.sunDepths(p, scene.Sun.Direction)
+		if !lit {
+			t.Fatalf("Expected %v to be lit", p)
+		}
+		return rayleigh
+	}
+	if few, many := depths(3), depths(50); nearlyEqual(few, many, 1e-6) {
+		t.Errorf("Expected the sun sample count to change the table depths, got %v for both", few)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "math"
+
+// Infinite two sided plane through Point, e.g. a ground plane or reference grid.
+// The normal field is named N because Go does not allow a field and method to
+// share the name Normal.
+type Plane struct {
+	Point     Vector3
+	N         Vector3
+	Transform Matrix
+}
+
+var _ Shape = &Plane{}
+
+func (p Plane) Intersect(r Ray) Hit {
+	inv, ok := p.Transform.TryInverse()
+	if !ok {
+		return NoHit
+	}
+	or := inv.TransformRay(r)
+
+	n := p.N.Normalize()
+	d := n.Dot(or.Direction)
+	if math.Abs(d) < 1e-12 {
+		// Ray is parallel to the plane
+		return NoHit
+	}
+	t := p.Point.Sub(or.Origin).Dot(n) / d
+	if t > 1e-5 {
+		return Hit{p, t}
+	}
+	return NoHit
+}
+
+// Projects the position onto two axes orthogonal to the normal. The returned
+// coordinates are distances from Point and are not wrapped into [0, 1].
+func (p Plane) UV(wp Vector3) Vector3 {
+	lp := p.Transform.Inverse().MulPosition(wp).Sub(p.Point)
+	u, v := perpendicularAxes(p.N)
+	return Vector3{lp.Dot(u), lp.Dot(v), 0}
+}
+
+// Unit normal in world space. Like Sphere.Normal it transforms by the inverse
+// transpose so it stays perpendicular to the plane under non-uniform scaling.
+func (p Plane) Normal(wp Vector3) Vector3 {
+	return p.Transform.Inverse().Transpose().MulDirection(p.N).Normalize()
+}
+
+// Returns two unit vectors orthogonal to the normal and to each other
+func perpendicularAxes(n Vector3) (Vector3, Vector3) {
+	n = n.Normalize()
+	a := Vector3{1, 0, 0}
+	if math.Abs(n.X) > 0.9 {
+		a = Vector3{0, 1, 0}
+	}
+	u := a.Cross(n).Normalize()
+	return u, n.Cross(u)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPlaneIntersect(t *testing.T) {
+	p := Plane{Point: Vector3{0, -10, 0}, N: Vector3{0, 1, 0}, Transform: Identity()}
+
+	// Head on from above
+	h := p.Intersect(Ray{Vector3{0, 0, 0}, Vector3{0, -1, 0}})
+	if h.Shape == nil || !nearlyEqual(h.T, 10, 1e-12) {
+		t.Errorf("Expected hit at t=10, got %v", h)
+	}
+
+	// Parallel to the plane
+	if h := p.Intersect(Ray{Vector3{0, 0, 0}, Vector3{1, 0, 0}}); h != NoHit {
+		t.Errorf("Expected parallel ray to miss, got %v", h)
+	}
+
+	// From behind the plane
+	h = p.Intersect(Ray{Vector3{0, -20, 0}, Vector3{0, 1, 0}})
+	if h.Shape == nil || !nearlyEqual(h.T, 10, 1e-12) {
+		t.Errorf("Expected hit from behind at t=10, got %v", h)
+	}
+
+	// Pointing away from the plane
+	if h := p.Intersect(Ray{Vector3{0, 0, 0}, Vector3{0, 1, 0}}); h != NoHit {
+		t.Errorf("Expected ray pointing away to miss, got %v", h)
+	}
+}
+
+func TestPlaneTransform(t *testing.T) {
+	p := Plane{N: Vector3{0, 1, 0}, Transform: Translate(Vector3{0, -10, 0})}
+	h := p.Intersect(Ray{Vector3{0, 0, 0}, Vector3{0, -1, 0}})
+	if h.Shape == nil || !nearlyEqual(h.T, 10, 1e-12) {
+		t.Errorf("Expected hit at t=10, got %v", h)
+	}
+}
+
+func TestPlaneUV(t *testing.T) {
+	p := Plane{Point: Vector3{0, -10, 0}, N: Vector3{0, 1, 0}, Transform: Identity()}
+	if uv := p.UV(Vector3{0, -10, 0}); uv != (Vector3{}) {
+		t.Errorf("Expected UV at the plane point to be zero, got %v", uv)
+	}
+	uv := p.UV(Vector3{3, -10, 4})
+	if !nearlyEqual(uv.Length(), 5, 1e-12) {
+		t.Errorf("Expected UV to preserve distance within the plane, got %v", uv)
+	}
+}
+
+func TestPlaneNormalScaled(t *testing.T) {
+	// The local plane x + y = 0 stretched along X becomes x/2 + y = 0
+	m := Translate(Vector3{0, 3, 0}).Mul(Scale(Vector3{2, 1, 1}))
+	s := Plane{Point: Vector3{0, 0, 0}, N: Vector3{1, 1, 0}, Transform: m}
+	n := s.Normal(Vector3{0, 3, 0})
+	if want := (Vector3{1, 2, 0}).Normalize(); n.DistanceTo(want) > 1e-12 {
+		t.Errorf("Expected normal %v got %v", want, n)
+	}
+	// Perpendicular to directions lying in the transformed surface
+	if d := m.MulDirection(Vector3{1, -1, 0}); math.Abs(n.Dot(d)) > 1e-12 {
+		t.Errorf("Expected %v to be perpendicular to %v", n, d)
+	}
+}
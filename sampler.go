@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Deterministic source of random numbers for one pixel. Each pixel gets its own
+// sequence seeded from its coordinates and the frame number, so a render does not
+// depend on which goroutine shades which pixel. A Sampler is not safe for
+// concurrent use, create one per pixel.
+type Sampler struct {
+	rng *rand.Rand
+}
+
+func NewSampler(x, y, frame int) *Sampler {
+	// Pack the coordinates into distinct bit ranges so nearby pixels and frames
+	// never share a seed, images up to 2^21 pixels wide and tall
+	seed := uint64(frame)<<42 | uint64(y&(1<<21-1))<<21 | uint64(x&(1<<21-1))
+	return &Sampler{rand.New(rand.NewSource(int64(seed)))}
+}
+
+// Returns a value in [0,1)
+func (s *Sampler) Float() float64 {
+	return s.rng.Float64()
+}
+
+// Returns a point in the unit square [0,1)x[0,1) in the X and Y components
+func (s *Sampler) Vec2() Vector3 {
+	return Vector3{s.rng.Float64(), s.rng.Float64(), 0}
+}
+
+// Returns a unit direction uniformly distributed over the cone of directions within
+// angle radians of the unit vector axis
+func (s *Sampler) Cone(axis Vector3, angle float64) Vector3 {
+	cosT := 1 - s.rng.Float64()*(1-math.Cos(angle))
+	sinT := math.Sqrt(math.Max(0, 1-cosT*cosT))
+	phi := 2 * math.Pi * s.rng.Float64()
+	u, v := perpendicularAxes(axis)
+	return axis.Multiply(cosT).Add(u.Multiply(sinT * math.Cos(phi))).Add(v.Multiply(sinT * math.Sin(phi))).Normalize()
+}
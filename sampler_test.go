@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSamplerDeterministic(t *testing.T) {
+	a, b := NewSampler(3, 7, 0), NewSampler(3, 7, 0)
+	for i := 0; i < 100; i++ {
+		if fa, fb := a.Float(), b.Float(); fa != fb {
+			t.Fatalf("Sample %v: expected identical sequences, got %v and %v", i, fa, fb)
+		}
+		if va, vb := a.Vec2(), b.Vec2(); va != vb {
+			t.Fatalf("Sample %v: expected identical sequences, got %v and %v", i, va, vb)
+		}
+	}
+
+	for _, other := range []*Sampler{NewSampler(4, 7, 0), NewSampler(3, 8, 0), NewSampler(3, 7, 1), NewSampler(7, 3, 0)} {
+		a := NewSampler(3, 7, 0)
+		same := true
+		for i := 0; i < 10; i++ {
+			if a.Float() != other.Float() {
+				same = false
+			}
+		}
+		if same {
+			t.Errorf("Expected different seeds to diverge")
+		}
+	}
+}
+
+func TestSamplerRange(t *testing.T) {
+	s := NewSampler(0, 0, 0)
+	for i := 0; i < 1000; i++ {
+		v := s.Vec2()
+		if f := s.Float(); f < 0 || f >= 1 || v.X < 0 || v.X >= 1 || v.Y < 0 || v.Y >= 1 || v.Z != 0 {
+			t.Fatalf("Expected samples in [0,1), got %v and %v", f, v)
+		}
+	}
+}
+
+func TestSamplerCone(t *testing.T) {
+	s := NewSampler(1, 2, 3)
+	axis := Vector3{1, 2, -2}.Normalize()
+	angle := 0.1
+	var sum Vector3
+	for i := 0; i < 1000; i++ {
+		d := s.Cone(axis, angle)
+		if !nearlyEqual(d.Length(), 1, 1e-12) {
+			t.Fatalf("Expected a unit direction, got %v", d)
+		}
+		if d.Dot(axis) < math.Cos(angle)-1e-12 {
+			t.Fatalf("Expected %v within %v radians of %v", d, angle, axis)
+		}
+		sum = sum.Add(d)
+	}
+	// Samples are spread evenly around the axis
+	if mean := sum.Normalize(); mean.Dot(axis) < math.Cos(0.01) {
+		t.Errorf("Expected samples centered on %v, mean direction %v", axis, mean)
+	}
+}
@@ -0,0 +1,952 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// Everything needed to render an image of the planet and its atmosphere
+type Scene struct {
+	// The atmosphere is the shell between the planet and the outer atmosphere sphere
+	Atmosphere Sphere
+	Planet     Sphere
+	Camera     Camera
+
+	// The sun lights the surface and is the source of the in-scattered light
+	Sun DirectionalLight
+	// Scale of the AmbientSky light added to surfaces facing away from the sun,
+	// 0 disables it
+	Ambient float64
+	// Artistic multiplier applied to the in-scattered light, white leaves it unchanged
+	AtmosphereTint Color
+	// Additional lights illuminating the surfaces
+	Lights []Light
+	// Opaque shapes besides the planet, shaded with ShapeAlbedo
+	Shapes []Shape
+	// Optional visible disk for the sun, see NewSunDisk. Rays that reach it unblocked
+	// by the planet or the shapes see the sun intensity attenuated by the atmosphere.
+	SunDisk *Disk
+
+	// Planet albedo texture, MissingTextureAlbedo is used if nil
+	Texture       image.Image
+	TextureFilter TextureFilter
+	// Optional emissive texture, e.g. city lights, added to the planet surface
+	// facing away from the sun
+	NightTexture image.Image
+	// Optional tangent space normal map for the planet. It bends the normal used to
+	// light the surface, the geometry and the terminator are unchanged.
+	NormalMap image.Image
+	// Optional equirectangular background, e.g. a star map, seen by view rays that
+	// don't hit a surface. Black if nil.
+	Background image.Image
+
+	Width, Height int
+	// Anti-aliasing, each pixel averages an AA x AA grid of jittered sub-samples
+	AA int
+	// Number of frames averaged together, each with a different AA jitter
+	Frames int
+	// Number of goroutines used by Render
+	Threads int
+	// Applied to each pixel before it is clamped into the output image
+	ToneMapping ToneMapping
+	// Output gamma applied after tone mapping, 1 writes linear values
+	Gamma float64
+	// Integration samples along each view ray, and along each sun ray when the
+	// optical depth table is disabled
+	ViewSamples, SunSamples int
+	// Resolution of the sunlight optical depth table built by Render, in altitude
+	// and sun zenith angle entries. 0 integrates every sun ray instead.
+	DepthTableAltitudes, DepthTableAngles int
+	// If set the in-scattered light is computed at these wavelengths in nanometers
+	// and converted to RGB, instead of at the three RGB wavelengths. Surface colors
+	// and their attenuation stay RGB.
+	Wavelengths []float64
+	// Radius in pixels of the box blur applied to the rendered image before tone
+	// mapping to hide noise, 0 disables it
+	Denoise int
+	// Add the sunlight reflected off the lit planet surface below each in-scattering
+	// sample, see groundRadiance. Costly as it samples the texture and traces a sun
+	// ray at every sample.
+	Earthshine bool
+	// Leave out the planet surface and its shadow so view rays only see the
+	// atmosphere, for checking the sky colors. The planet still sets the altitude
+	// the atmosphere density is measured from.
+	SkyOnly bool
+	// Stop adding in-scattered light once the view ray transmittance back to the
+	// camera falls below this in every channel. Later samples would contribute at
+	// most this fraction of their light. 0 integrates the whole path.
+	TransmittanceCutoff float64
+
+	depthTable *opticalDepthTable
+	// Samples skipped by the transmittance cutoff, counted across render threads
+	skippedSamples atomic.Int64
+	// Sun rays integrated by sunDepths without the table, shadowed points skip them
+	sunRays atomic.Int64
+	// Frame being rendered, seeds the AA jitter
+	frame int
+}
+
+// Returns the default Earth scene
+func NewScene(tex image.Image) *Scene {
+	// World space -> Camera space
+	// Increase World X -> Move right in the camera
+	// Increase World Y -> Move up in the camera
+	// Increase World Z -> Move away from the camera (into screen)
+	// Both spheres are positioned by their transforms so that the planet's rotation
+	// happens about its own center rather than the world origin
+	return &Scene{
+		Atmosphere: Sphere{Vector3{0, 0, 0}, EarthRadius + EarthAtmosphereHeight, Translate(PlanetCenter)},
+		Planet:     Sphere{Vector3{0, 0, 0}, EarthRadius, Translate(PlanetCenter).Mul(Rotate(Vector3{0, 1, 0}, -0.5))},
+		Camera: Camera{
+			Position:   Vector3{0, 0, -40 * 1000 * 1000},
+			LookAt:     Vector3{0, 0, 0},
+			Up:         Vector3{0, 1, 0},
+			FOVDegrees: DefaultFOVDegrees,
+		},
+		Sun:     DirectionalLight{SunlightDir, SunlightIntensity},
+		Texture: tex,
+		Width:   ImageWidth,
+		Height:  ImageHeight,
+		AA:      1,
+		Frames:  1,
+		Threads: 1,
+		Gamma:   1,
+
+		AtmosphereTint: Color{1, 1, 1, 1},
+
+		ViewSamples: 50,
+		SunSamples:  5,
+
+		DepthTableAltitudes: 64,
+		DepthTableAngles:    64,
+	}
+}
+
+// Disk for the sun seen from center in the direction opposite sunDir, SunDistance
+// away and sized to subtend SunAngularRadius
+func NewSunDisk(center, sunDir Vector3) *Disk {
+	return &Disk{
+		Center:    center.Sub(sunDir.Multiply(SunDistance)),
+		N:         sunDir,
+		Radius:    SunDistance * math.Tan(SunAngularRadius),
+		Transform: Identity(),
+	}
+}
+
+// Scene for checking the sky colors without the planet surface. The camera stands
+// on the ground with the sun 20 degrees above the horizon off to the side, looking
+// out with the horizon along the bottom of the image and the zenith at the top.
+func NewSkyScene() *Scene {
+	s := NewScene(nil)
+	s.SkyOnly = true
+
+	toSun := s.Sun.Direction.Multiply(-1)
+	perp := toSun.Cross(Vector3{0, 1, 0}).Normalize()
+	elevation := 20 * math.Pi / 180
+	up := toSun.Multiply(math.Sin(elevation)).Add(perp.Multiply(math.Cos(elevation)))
+	side := up.Cross(toSun).Normalize()
+
+	s.Camera = Camera{
+		Position:   s.Planet.Center().Add(up.Multiply(EarthRadius + 2)),
+		Up:         up,
+		FOVDegrees: 90,
+	}
+	s.Camera.LookAt = s.Camera.Position.Add(side.Add(up))
+	return s
+}
+
+// Validate the scene parameters, returning every problem found. These are the
+// misconfigurations that otherwise quietly render black or NaN images.
+func (s *Scene) Check() []error {
+	so, si := s.Atmosphere, s.Planet
+
+	var errs []error
+	if s.Width <= 0 || s.Height <= 0 {
+		errs = append(errs, fmt.Errorf("image size %vx%v must be positive", s.Width, s.Height))
+	}
+	if si.Radius <= 0 {
+		errs = append(errs, fmt.Errorf("planet radius %v must be positive", si.Radius))
+	}
+	if so.Radius <= si.Radius {
+		errs = append(errs, fmt.Errorf("atmosphere radius %v must be greater than planet radius %v", so.Radius, si.Radius))
+	}
+	if !si.Transform.IsRigid() {
+		errs = append(errs, fmt.Errorf("planet transform must be rigid, without scaling"))
+	}
+	if !so.Transform.IsRigid() {
+		errs = append(errs, fmt.Errorf("atmosphere transform must be rigid, without scaling"))
+	}
+	if so.Center() != si.Center() {
+		errs = append(errs, fmt.Errorf("atmosphere center %v does not match planet center %v", so.Center(), si.Center()))
+	}
+	if math.Abs(s.Sun.Direction.Length()-1) > 1e-9 {
+		errs = append(errs, fmt.Errorf("sunlight direction %v is not normalized", s.Sun.Direction))
+	}
+	if s.Sun.Intensity < 0 {
+		errs = append(errs, fmt.Errorf("sunlight intensity %v is negative", s.Sun.Intensity))
+	}
+	if RayleighExtinction.R < 0 || RayleighExtinction.G < 0 || RayleighExtinction.B < 0 {
+		errs = append(errs, fmt.Errorf("rayleigh extinction %v has negative coefficients", RayleighExtinction))
+	}
+	if MieExtinction.R < 0 || MieExtinction.G < 0 || MieExtinction.B < 0 {
+		errs = append(errs, fmt.Errorf("mie extinction %v has negative coefficients", MieExtinction))
+	}
+	if OzoneAbsorption.R < 0 || OzoneAbsorption.G < 0 || OzoneAbsorption.B < 0 {
+		errs = append(errs, fmt.Errorf("ozone absorption %v has negative coefficients", OzoneAbsorption))
+	}
+	if OzoneWidth <= 0 {
+		errs = append(errs, fmt.Errorf("ozone layer width %v must be positive", OzoneWidth))
+	}
+	if RayleighDensityScale <= 0 {
+		errs = append(errs, fmt.Errorf("rayleigh density scale %v must be positive", RayleighDensityScale))
+	}
+	if MieDensityScale <= 0 {
+		errs = append(errs, fmt.Errorf("mie density scale %v must be positive", MieDensityScale))
+	}
+	if MultiScatterFactor < 0 || MultiScatterFactor >= 1 {
+		errs = append(errs, fmt.Errorf("multiple scattering factor %v must be in [0,1)", MultiScatterFactor))
+	}
+	if MaxIntegrationStep < 0 {
+		errs = append(errs, fmt.Errorf("max integration distance %v is negative", MaxIntegrationStep))
+	}
+	if s.Frames < 1 {
+		errs = append(errs, fmt.Errorf("frame count %v must be at least 1", s.Frames))
+	}
+	for _, l := range s.Wavelengths {
+		if l <= 0 {
+			errs = append(errs, fmt.Errorf("wavelength %v must be positive", l))
+			break
+		}
+	}
+	if s.TransmittanceCutoff < 0 || s.TransmittanceCutoff >= 1 {
+		errs = append(errs, fmt.Errorf("transmittance cutoff %v must be in [0,1)", s.TransmittanceCutoff))
+	}
+	if s.Denoise < 0 {
+		errs = append(errs, fmt.Errorf("denoise radius %v is negative", s.Denoise))
+	}
+	if s.ViewSamples < 2 || s.SunSamples < 2 {
+		errs = append(errs, fmt.Errorf("view samples %v and sun samples %v must be at least 2", s.ViewSamples, s.SunSamples))
+	}
+	if s.Gamma <= 0 {
+		errs = append(errs, fmt.Errorf("gamma %v must be positive", s.Gamma))
+	}
+	if (s.DepthTableAltitudes != 0 || s.DepthTableAngles != 0) && (s.DepthTableAltitudes < 2 || s.DepthTableAngles < 2) {
+		errs = append(errs, fmt.Errorf("optical depth table size %vx%v must be at least 2x2, or 0 to disable", s.DepthTableAltitudes, s.DepthTableAngles))
+	}
+	if s.Camera.Position == s.Camera.LookAt {
+		errs = append(errs, fmt.Errorf("camera position and look at are both %v", s.Camera.Position))
+	}
+	if s.Camera.FOVDegrees <= 0 || s.Camera.FOVDegrees >= 180 {
+		errs = append(errs, fmt.Errorf("camera field of view %v must be between 0 and 180 degrees", s.Camera.FOVDegrees))
+	}
+	// The atmosphere integration assumes view rays start above the planet surface
+	if si.Contains(s.Camera.Position) {
+		errs = append(errs, fmt.Errorf("camera position %v is below the planet surface", s.Camera.Position))
+	}
+	return errs
+}
+
+// Render the camera view of the scene, tone mapped and gamma encoded for display
+func (s *Scene) Render() *image.RGBA {
+	return s.displayImage(s.RenderHDR())
+}
+
+// Render like Render but hand out square tiles of tileSize pixels to the workers
+// instead of scanlines. Expensive regions like the planet are spread over more
+// tiles, which balances the load better. If progress is not nil it is called after
+// every tile with the number of tiles completed so far, over all frames, and the
+// total. Calls to progress are serialized.
+func (s *Scene) RenderTiled(tileSize int, progress func(done, total int)) *image.RGBA {
+	bounds := image.Rect(0, 0, s.Width, s.Height)
+	return s.displayImage(s.renderHDR(func(pix []Color, frame, frames int) {
+		var frameProgress func(done, total int)
+		if progress != nil {
+			frameProgress = func(done, total int) {
+				progress(frame*total+done, frames*total)
+			}
+		}
+		renderTiles(bounds, tileSize, s.Threads, func(tile image.Rectangle) {
+			for y := tile.Min.Y; y < tile.Max.Y; y++ {
+				for x := tile.Min.X; x < tile.Max.X; x++ {
+					pix[y*s.Width+x] = s.renderPixel(x, y)
+				}
+			}
+		}, frameProgress)
+	}))
+}
+
+// Tone map and gamma encode the linear colors in pix
+func (s *Scene) displayImage(pix []Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, s.Width, s.Height))
+	renderImage(img, s.Threads, func(x, y int) Color {
+		c := s.ToneMapping.Apply(pix[y*s.Width+x])
+		if s.Gamma != 1 {
+			c = c.GammaEncode(s.Gamma)
+		}
+		return c.Sanitize()
+	})
+	return img
+}
+
+// Render the camera view of the scene into a row major buffer of linear, unclamped
+// colors
+func (s *Scene) RenderHDR() []Color {
+	return s.renderHDR(func(pix []Color, _, _ int) {
+		renderRows(0, s.Height, s.Threads, func(y int) {
+			for x := 0; x < s.Width; x++ {
+				pix[y*s.Width+x] = s.renderPixel(x, y)
+			}
+		})
+	})
+}
+
+// Build the optical depth table then call renderFrame to fill pix for each frame
+// and average the frames together
+func (s *Scene) renderHDR(renderFrame func(pix []Color, frame, frames int)) []Color {
+	s.depthTable = nil
+	if s.DepthTableAltitudes > 0 && s.DepthTableAngles > 0 {
+		s.depthTable = s.buildOpticalDepthTable(s.DepthTableAltitudes, s.DepthTableAngles)
+	}
+	acc := make([]Color, s.Width*s.Height)
+	pix := make([]Color, s.Width*s.Height)
+	frames := s.Frames
+	if frames < 1 {
+		frames = 1
+	}
+	for s.frame = 0; s.frame < frames; s.frame++ {
+		renderFrame(pix, s.frame, frames)
+		accumulate(acc, pix, s.frame)
+	}
+	if n := sanitizePixels(acc); n > 0 {
+		fmt.Printf("warning: replaced NaN or infinite values in %d pixels\n", n)
+	}
+	if s.Denoise > 0 {
+		acc = boxBlur(acc, s.Width, s.Height, s.Denoise)
+	}
+	return acc
+}
+
+// Sanitize every color in pix, returning how many were changed
+func sanitizePixels(pix []Color) int {
+	n := 0
+	for i, c := range pix {
+		if sc := c.Sanitize(); sc != c {
+			pix[i] = sc
+			n++
+		}
+	}
+	return n
+}
+
+// Fold frame into the running average acc of the n frames before it
+func accumulate(acc, frame []Color, n int) {
+	t := 1 / float64(n+1)
+	for i := range acc {
+		acc[i] = acc[i].Lerp(frame[i], t)
+	}
+}
+
+// Shade every pixel within the bounds of img
+func renderImage(img *image.RGBA, threads int, shade func(x, y int) Color) {
+	bounds := img.Bounds()
+	renderRows(bounds.Min.Y, bounds.Max.Y, threads, func(y int) {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			img.Set(x, y, shade(x, y).Pack())
+		}
+	})
+}
+
+// Call tile for every tileSize square of bounds, tiles on the right and bottom edges
+// are clipped to bounds. Tiles are handed out to threads worker goroutines. If
+// progress is not nil it is called with the number of finished tiles and the total
+// after each tile completes.
+func renderTiles(bounds image.Rectangle, tileSize, threads int, tile func(r image.Rectangle), progress func(done, total int)) {
+	if tileSize < 1 {
+		tileSize = 1
+	}
+	if threads < 1 {
+		threads = 1
+	}
+	var tiles []image.Rectangle
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += tileSize {
+		for x := bounds.Min.X; x < bounds.Max.X; x += tileSize {
+			tiles = append(tiles, image.Rect(x, y, x+tileSize, y+tileSize).Intersect(bounds))
+		}
+	}
+
+	work := make(chan image.Rectangle)
+	var mu sync.Mutex
+	done := 0
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range work {
+				tile(r)
+				if progress != nil {
+					mu.Lock()
+					done++
+					progress(done, len(tiles))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, r := range tiles {
+		work <- r
+	}
+	close(work)
+	wg.Wait()
+}
+
+// Call row for every y in [minY, maxY). Rows are handed out to threads worker
+// goroutines, each row is handled by a single worker so no locking is needed.
+func renderRows(minY, maxY, threads int, row func(y int)) {
+	rows := make(chan int)
+	if threads < 1 {
+		threads = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for y := range rows {
+				row(y)
+			}
+		}()
+	}
+
+	for y := minY; y < maxY; y++ {
+		rows <- y
+	}
+	close(rows)
+	wg.Wait()
+}
+
+// Relative density of air molecules at altitude h, given as a fraction of the
+// atmosphere height. It is 1 at the planet surface and falls off exponentially.
+func rayleighDensity(h float64) float64 {
+	return math.Exp(-h / RayleighDensityScale)
+}
+
+// Relative density of aerosols at altitude h, given as a fraction of the atmosphere
+// height. Aerosols are concentrated closer to the surface than the air molecules so
+// they fall off faster.
+func mieDensity(h float64) float64 {
+	return math.Exp(-h / MieDensityScale)
+}
+
+// Altitude of world space position p as a fraction of the atmosphere height
+func (s *Scene) relativeAltitude(p Vector3) float64 {
+	return s.Planet.Altitude(p) / (s.Atmosphere.Radius - s.Planet.Radius)
+}
+
+// Relative density of the atmosphere at world space position p. Density falls off
+// exponentially with altitude and is 1 at the planet surface.
+func (s *Scene) atmosphereDensity(p Vector3) float64 {
+	return rayleighDensity(s.relativeAltitude(p))
+}
+
+// Relative density of ozone at world space position p, a tent function that is 1
+// at OzoneCenterAltitude and 0 outside the layer
+func (s *Scene) ozoneDensity(p Vector3) float64 {
+	h := s.Planet.Altitude(p) - OzoneCenterAltitude
+	return math.Max(0, 1-math.Abs(h)/(OzoneWidth/2))
+}
+
+// Compute optical length along the ray
+// Using https://developer.nvidia.com/gpugems/GPUGems2/gpugems2_chapter16.html as a guide
+func (s *Scene) optLengthFn(ray Ray) func(t, dx float64) float64 {
+	return func(t, _ float64) float64 {
+		p := ray.At(t)
+		return s.atmosphereDensity(p)
+	}
+}
+
+// Per channel extinction from Rayleigh, Mie and ozone optical lengths
+func extinctionFromDepths(rayleigh, mie, ozone float64) Vector3 {
+	return Vector3{
+		RayleighExtinction.R*rayleigh + MieExtinction.R*mie + OzoneAbsorption.R*ozone,
+		RayleighExtinction.G*rayleigh + MieExtinction.G*mie + OzoneAbsorption.G*ozone,
+		RayleighExtinction.B*rayleigh + MieExtinction.B*mie + OzoneAbsorption.B*ozone,
+	}
+}
+
+// Rayleigh, Mie and ozone optical lengths along the ray from 0 to length
+func (s *Scene) opticalDepths(r Ray, length float64, n int) (float64, float64, float64) {
+	ol := numIntegrate(s.optLengthFn(r), 0, length, n)
+	mie := numIntegrate(func(t, _ float64) float64 {
+		return mieDensity(s.relativeAltitude(r.At(t)))
+	}, 0, length, n)
+	var ozone float64
+	if OzoneAbsorption != (Color{}) {
+		ozone = numIntegrate(func(t, _ float64) float64 {
+			return s.ozoneDensity(r.At(t))
+		}, 0, length, n)
+	}
+	return ol, mie, ozone
+}
+
+// Per channel extinction along the ray from 0 to length, the Rayleigh and Mie
+// optical lengths scaled by their coefficients plus the ozone absorption
+func (s *Scene) extinction(r Ray, length float64, n int) Vector3 {
+	return extinctionFromDepths(s.opticalDepths(r, length, n))
+}
+
+// Fraction of light that survives travelling distance length along the ray through
+// the atmosphere, computed per channel from the extinction (Fex)
+func (s *Scene) viewTransmittance(r Ray, length float64, n int) Color {
+	e := s.extinction(r, length, n)
+	return Color{math.Exp(-e.X), math.Exp(-e.Y), math.Exp(-e.Z), 1}
+}
+
+// Sunlight arriving at world space position p inside the atmosphere. Returns false
+// if the planet blocks the sun. Every point is tested individually so samples high
+// in the atmosphere can still be lit after the surface below them has passed the
+// terminator, which is what produces the twilight glow. sunDir is the direction the
+// sunlight travels, see sunDirection.
+func (s *Scene) sunlightAt(p, sunDir Vector3) (Vector3, bool) {
+	rayleigh, mie, ozone, lit := s.sunDepths(p, sunDir)
+	if !lit {
+		return Vector3{}, false
+	}
+
+	// Determine how much sunlight reaches the point. It gets attenuated as it
+	// passes through the atmosphere. To keep things simple We ignore in scattering
+	// events along this path.
+	e := extinctionFromDepths(rayleigh, mie, ozone)
+	return Vector3{
+		s.Sun.Intensity * math.Exp(-e.X),
+		s.Sun.Intensity * math.Exp(-e.Y),
+		s.Sun.Intensity * math.Exp(-e.Z),
+	}, true
+}
+
+// Rayleigh, Mie and ozone optical lengths the sunlight travels through to reach
+// world space position p, see sunlightAt. Returns false if the planet blocks the sun.
+func (s *Scene) sunDepths(p, sunDir Vector3) (float64, float64, float64, bool) {
+	// First off, is this point in the shadow of the planet?
+	toSun := Vector3{-sunDir.X, -sunDir.Y, -sunDir.Z}
+	rs := Ray{p.Add(toSun.Multiply(ShadowRayEpsilon)), toSun}
+	if !s.SkyOnly && s.Planet.Occludes(rs) {
+		return 0, 0, 0, false
+	}
+
+	// Optical lengths along the sunlight ray from p to the edge of the atmosphere.
+	// The table only covers rays above the horizon, which is not enough without
+	// the planet.
+	if s.depthTable != nil && !s.SkyOnly {
+		up := p.Sub(s.Planet.Center())
+		r := up.Length()
+		rayleigh, mie, ozone := s.depthTable.lookup(r-s.Planet.Radius, up.Dot(rs.Direction)/r)
+		return rayleigh, mie, ozone, true
+	}
+	// Fire a ray from p towards the sun, see how far to the outer atmosphere
+	// Points on the outer boundary can round to just outside it and miss, the
+	// sunlight reaches them unattenuated
+	if rsHit := s.Atmosphere.Intersect(rs); rsHit != NoHit {
+		s.sunRays.Add(1)
+		rayleigh, mie, ozone := s.opticalDepths(rs, rsHit.T, s.SunSamples)
+		return rayleigh, mie, ozone, true
+	}
+	return 0, 0, 0, true
+}
+
+// Radiance of the sunlight reflected off the planet surface directly below world
+// space position p, treating the surface as a Lambertian reflector. Zero on the
+// night side. The light is not attenuated on its way up to p.
+func (s *Scene) groundRadiance(p, sunDir Vector3) Vector3 {
+	up := p.Sub(s.Planet.Center()).Normalize()
+	cosSun := -up.Dot(sunDir)
+	if cosSun <= 0 || s.SkyOnly {
+		return Vector3{}
+	}
+	ground := s.Planet.Center().Add(up.Multiply(s.Planet.Radius))
+	sun, lit := s.sunlightAt(ground, sunDir)
+	if !lit {
+		return Vector3{}
+	}
+
+	albedo := MissingTextureAlbedo
+	if s.Texture != nil {
+		uv := s.Planet.UV(ground)
+		albedo = s.TextureFilter.Sample(s.Texture, uv.X, uv.Y)
+	}
+	// Irradiance E reflected equally in all directions leaves as radiance E/pi
+	f := cosSun / math.Pi
+	return Vector3{albedo.R * sun.X * f, albedo.G * sun.Y * f, albedo.B * sun.Z * f}
+}
+
+// Direction the sunlight travels. If sampler is not nil the light comes from a
+// random point on the sun disk.
+func (s *Scene) sunDirection(sampler *Sampler) Vector3 {
+	if sampler == nil || SunAngularRadius <= 0 {
+		return s.Sun.Direction
+	}
+	return sampler.Cone(s.Sun.Direction, SunAngularRadius)
+}
+
+// Compute the color of pixel x, y of the camera view
+func (s *Scene) renderPixel(x, y int) Color {
+	if s.AA <= 1 {
+		return s.shadeRay(s.Camera.RayFor(x, y, s.Width, s.Height), nil)
+	}
+
+	// Seeded from the pixel coordinates so renders are reproducible
+	return s.supersample(x, y, NewSampler(x, y, s.frame))
+}
+
+// Average an AA x AA grid of sub-samples across pixel x, y, each jittered within
+// its grid cell
+func (s *Scene) supersample(x, y int, sampler *Sampler) Color {
+	n := s.AA
+	var sum Color
+	for j := 0; j < n; j++ {
+		for i := 0; i < n; i++ {
+			jitter := sampler.Vec2()
+			px := float64(x) - 0.5 + (float64(i)+jitter.X)/float64(n)
+			py := float64(y) - 0.5 + (float64(j)+jitter.Y)/float64(n)
+			c := s.shadeRay(s.Camera.RayThrough(px, py, s.Width, s.Height), sampler)
+			sum = Color{sum.R + c.R, sum.G + c.G, sum.B + c.B, sum.A + c.A}
+		}
+	}
+	k := float64(n * n)
+	return Color{sum.R / k, sum.G / k, sum.B / k, sum.A / k}
+}
+
+// Planet normal n at cp bent by the normal map texel at uv. Texels hold the tangent
+// space normal with each component mapped from [-1,1] to [0,1], red along the
+// tangent, green along the bitangent, down the texture as v increases, and blue
+// along n.
+func (s *Scene) mapNormal(n, cp, uv Vector3) Vector3 {
+	m := s.TextureFilter.Sample(s.NormalMap, uv.X, uv.Y)
+	tangent, bitangent := s.Planet.Tangent(cp)
+	return tangent.Multiply(2*m.R - 1).Add(bitangent.Multiply(2*m.G - 1)).Add(n.Multiply(2*m.B - 1)).Normalize()
+}
+
+// Color of the surface hit at world space position cp by a ray in direction dir, lit
+// by the sun and the other lights. Surfaces are double sided, the side facing the
+// ray is shaded. The planet is textured, other shapes use ShapeAlbedo.
+func (s *Scene) shadeSurface(h Hit, cp, dir Vector3) Color {
+	n := faceForward(h.Shape.Normal(cp), dir)
+	cosSun := -n.Dot(s.Sun.Direction)
+
+	isPlanet := h.Shape == Shape(s.Planet)
+	var uv Vector3
+	ln := n
+	if isPlanet {
+		uv = s.Planet.UV(cp)
+		if s.NormalMap != nil {
+			ln = s.mapNormal(n, cp, uv)
+		}
+	}
+
+	// Some temporary lighting from the sun (this needs to be tweaked)
+	l := math.Max(0, -ln.Dot(s.Sun.Direction)) * s.Sun.Intensity
+	for _, light := range s.Lights {
+		dir, intensity := light.Illuminate(cp)
+		l += math.Max(0, -ln.Dot(dir)) * intensity
+	}
+
+	// Surfaces facing away from the sun would be black, stand in for the light
+	// reaching them through multiple scattering
+	var ambient Color
+	if cosSun <= 0 {
+		ambient = AmbientSky.MultiplyRGB(s.Ambient)
+	}
+
+	// Apply sunlight amount to the albedo
+	if !isPlanet {
+		return ShapeAlbedo.MultiplyRGB(l).AddRGB(ambient)
+	}
+	c := MissingTextureAlbedo
+	if s.Texture != nil {
+		c = s.TextureFilter.Sample(s.Texture, uv.X, uv.Y)
+	}
+	c = c.MultiplyRGB(l).AddRGB(ambient)
+
+	// Night side emission fades in smoothly past the terminator
+	if s.NightTexture != nil {
+		if w := nightWeight(cosSun); w > 0 {
+			c = c.AddRGB(s.TextureFilter.Sample(s.NightTexture, uv.X, uv.Y).MultiplyRGB(w))
+		}
+	}
+	return c
+}
+
+// Weight of the night texture for a surface where cosSun is the cosine of the angle
+// between the normal and the direction to the sun. 0 on the day side rising
+// smoothly to 1 at NightBlendWidth past the terminator.
+func nightWeight(cosSun float64) float64 {
+	x := clamp(-cosSun/NightBlendWidth, 0, 1)
+	return x * x * (3 - 2*x)
+}
+
+// Compute the color seen along the camera ray r. sampler picks the sun direction for
+// each integration sample and may be nil.
+func (s *Scene) shadeRay(r Ray, sampler *Sampler) Color {
+	so, si := s.Atmosphere, s.Planet
+
+	c := Color{0, 0, 0, 1}
+
+	// Is the sun directly visible?
+	sunVisible := false
+	if s.SunDisk != nil {
+		blockers := s.Shapes
+		if !s.SkyOnly {
+			blockers = append([]Shape{si}, s.Shapes...)
+		}
+		// The sun is further away than NoHit so a miss must be checked for
+		if hd := s.SunDisk.Intersect(r); hd != NoHit {
+			if hb := closestHit(r, blockers); hb == NoHit || hb.T > hd.T {
+				sunVisible = true
+				c = Color{s.Sun.Intensity, s.Sun.Intensity, s.Sun.Intensity, 1}
+			}
+		}
+	}
+	if !sunVisible && s.Background != nil {
+		uv := directionUV(r.Direction)
+		c = s.TextureFilter.Sample(s.Background, uv.X, uv.Y)
+	}
+
+	// Does it hit the planet outer atmosphere?
+	// Ray definitions
+	// r - the starting ray from the camera into the scene
+	// ri - from the hit point on outer atmosphere this ray is in the same direction
+	//   as r. used to find if the view ray hits the planet or exits the atmosphere
+	// rs - ray from a point in the atmosphere back towards the sun
+	// rc - ray from a point back towards the camera
+
+	// Does it hit the planet outer atmosphere?
+	ho := so.Intersect(r)
+	// A camera inside the atmosphere, e.g. on the ground of a sky only scene, starts
+	// the view ray at the camera
+	inside := so.Contains(r.Origin)
+
+	// Shapes in front of the atmosphere are seen without any scattering
+	if hs := closestHit(r, s.Shapes); !inside && hs != NoHit && hs.T < ho.T {
+		return s.shadeSurface(hs, r.At(hs.T), r.Direction)
+	}
+
+	if ho != NoHit {
+		// Advance along ray very slightly to avoid intersecting
+		// planet atmosphere again and compute start point for the ray
+		ri := r
+		if !inside {
+			ri = advanceRay(r, ho.T)
+		}
+
+		var olE float64
+
+		// Does it hit the planet or another shape inside the atmosphere?
+		hi := NoHit
+		if !s.SkyOnly {
+			hi = si.Intersect(ri)
+		}
+		if hs := closestHit(ri, s.Shapes); hs.T < hi.T {
+			hi = hs
+		}
+		if hi != NoHit {
+			// Optical length calculation ends at the surface
+			olE = hi.T
+
+			// Compute contact point in world space
+			cp := ri.At(hi.T)
+			c = s.shadeSurface(hi, cp, ri.Direction)
+		} else {
+			// Did not hit planet, compute where it hits outer atmosphere
+			ho2 := so.Intersect(ri)
+			if ho2 != NoHit {
+				olE = ho2.T
+			}
+			// If it did not hit then the first ray grazed the atmosphere and we take the end
+			// point to be the same as the start point, 0
+		}
+
+		// Optical lengths of the view ray from its start to the current sample.
+		// numIntegrateV evaluates the samples in order so these accumulate with
+		// the trapezoidal rule alongside the integral.
+		var viewRayleigh, viewMie, viewOzone float64
+		var prevT, prevRayleigh, prevMie, prevOzone float64
+		first := true
+
+		// Sunlight scattered towards the camera at distance t along the view ray. It
+		// is the sunlight reaching the sample scaled by the scattering coefficients,
+		// densities and phase functions, then attenuated on its way back along the
+		// view ray to the start of the atmosphere.
+		inScatterFn := func(t, _ float64) Vector3 {
+			p := ri.At(t)
+
+			h := s.relativeAltitude(p)
+			dRayleigh := rayleighDensity(h)
+			dMie := mieDensity(h)
+			dOzone := s.ozoneDensity(p)
+			if !first {
+				viewRayleigh += (prevRayleigh + dRayleigh) * (t - prevT) / 2
+				viewMie += (prevMie + dMie) * (t - prevT) / 2
+				viewOzone += (prevOzone + dOzone) * (t - prevT) / 2
+			}
+			first = false
+			prevT, prevRayleigh, prevMie, prevOzone = t, dRayleigh, dMie, dOzone
+
+			e := extinctionFromDepths(viewRayleigh, viewMie, viewOzone)
+			if s.pastCutoff(math.Min(e.X, math.Min(e.Y, e.Z))) {
+				return Vector3{}
+			}
+
+			sunDir := s.sunDirection(sampler)
+			sunColor, lit := s.sunlightAt(p, sunDir)
+			if !lit {
+				// No contributions (for now)
+				return Vector3{}
+			}
+
+			// Cosine of the angle between the view ray and the sunlight reaching
+			// this sample
+			cosT := ri.Direction.Dot(sunDir)
+			phaseRayleigh := (3 / (16.0 * math.Pi)) * (cosT*cosT + 1)
+			// Mie scattering from aerosols is strongly forward scattering, the phase
+			// function takes the angle between the sunlight and the direction back
+			// towards the camera
+			phaseMie := miePhase(-cosT, MieG)
+
+			// Aerosols absorb very little so the Mie extinction is used as the
+			// scattering coefficient
+			rayleigh := dRayleigh * phaseRayleigh
+			mie := dMie * phaseMie
+			scattered := Vector3{
+				sunColor.X * (RayleighExtinction.R*rayleigh + MieExtinction.R*mie),
+				sunColor.Y * (RayleighExtinction.G*rayleigh + MieExtinction.G*mie),
+				sunColor.Z * (RayleighExtinction.B*rayleigh + MieExtinction.B*mie),
+			}
+			if s.Earthshine {
+				// The ground fills the lower hemisphere, integrating its radiance
+				// over the isotropic phase function 1/(4pi) gives half of it
+				g := s.groundRadiance(p, sunDir).Multiply(0.5)
+				scattered = scattered.Add(Vector3{
+					g.X * (RayleighExtinction.R*dRayleigh + MieExtinction.R*dMie),
+					g.Y * (RayleighExtinction.G*dRayleigh + MieExtinction.G*dMie),
+					g.Z * (RayleighExtinction.B*dRayleigh + MieExtinction.B*dMie),
+				})
+			}
+			return Vector3{
+				scattered.X * math.Exp(-e.X),
+				scattered.Y * math.Exp(-e.Y),
+				scattered.Z * math.Exp(-e.Z),
+			}
+		}
+
+		steps := integrationSteps(olE, s.ViewSamples, MaxIntegrationStep)
+		var inScatterCol Color
+		if len(s.Wavelengths) > 0 {
+			inScatterCol = s.inScatterSpectrum(ri, olE, steps, sampler, s.Wavelengths).ToColor()
+		} else {
+			inScatterCol = numIntegrateV(inScatterFn, 0, olE, steps).ToColor()
+		}
+		// Approximate the light scattered more than once
+		inScatterCol = inScatterCol.MultiplyRGB(1 / (1 - MultiScatterFactor))
+
+		// Light reflected off the planet or from the sun or background is attenuated
+		// on its way to the camera
+		if (hi != NoHit || sunVisible || s.Background != nil) && !c.IsBlack() {
+			fex := s.viewTransmittance(ri, olE, steps)
+			c = Color{c.R * fex.R, c.G * fex.G, c.B * fex.B, c.A}
+		}
+
+		// Final color = planet color * Fex + Fin
+		c = addInScatter(c, inScatterCol, s.AtmosphereTint)
+	}
+	return c
+}
+
+// Sunlight scattered towards the camera along ri from 0 to length, computed at each
+// of the wavelengths. This is the spectral counterpart of the in-scattering
+// integral in shadeRay, with the sun a flat spectrum of its intensity, and uses the
+// same trapezoidal rule over n samples.
+func (s *Scene) inScatterSpectrum(ri Ray, length float64, n int, sampler *Sampler, wavelengths []float64) Spectrum {
+	k := len(wavelengths)
+	rayleighCoef, mieCoef, ozoneCoef := make([]float64, k), make([]float64, k), make([]float64, k)
+	for j, l := range wavelengths {
+		rayleighCoef[j], mieCoef[j], ozoneCoef[j] = rayleighExtinctionAt(l), mieExtinctionAt(l), ozoneAbsorptionAt(l)
+	}
+
+	out := NewSpectrum(wavelengths, 0)
+	prev, cur := make([]float64, k), make([]float64, k)
+	dx := length / float64(n-1)
+	var viewRayleigh, viewMie, viewOzone float64
+	var prevRayleigh, prevMie, prevOzone float64
+	for i := 0; i < n; i++ {
+		t := float64(i) * dx
+		p := ri.At(t)
+
+		h := s.relativeAltitude(p)
+		dRayleigh, dMie, dOzone := rayleighDensity(h), mieDensity(h), s.ozoneDensity(p)
+		if i > 0 {
+			viewRayleigh += (prevRayleigh + dRayleigh) * dx / 2
+			viewMie += (prevMie + dMie) * dx / 2
+			viewOzone += (prevOzone + dOzone) * dx / 2
+		}
+		prevRayleigh, prevMie, prevOzone = dRayleigh, dMie, dOzone
+
+		minView := math.Inf(1)
+		for j := range cur {
+			cur[j] = 0
+			minView = math.Min(minView, rayleighCoef[j]*viewRayleigh+mieCoef[j]*viewMie+ozoneCoef[j]*viewOzone)
+		}
+		sunDir := s.sunDirection(sampler)
+		if s.pastCutoff(minView) {
+			// Too little light makes it back to the camera, leave the sample black
+		} else if sunRayleigh, sunMie, sunOzone, lit := s.sunDepths(p, sunDir); lit {
+			cosT := ri.Direction.Dot(sunDir)
+			rayleigh := dRayleigh * (3 / (16.0 * math.Pi)) * (cosT*cosT + 1)
+			mie := dMie * miePhase(-cosT, MieG)
+
+			// The ground radiance is only known in RGB, it is interpolated
+			// across the wavelengths
+			var ground Color
+			if s.Earthshine {
+				ground = s.groundRadiance(p, sunDir).Multiply(0.5).ToColor()
+			}
+
+			// Attenuated along the sun ray and then the view ray
+			for j, l := range wavelengths {
+				e := rayleighCoef[j]*(sunRayleigh+viewRayleigh) + mieCoef[j]*(sunMie+viewMie) + ozoneCoef[j]*(sunOzone+viewOzone)
+				cur[j] = s.Sun.Intensity * (rayleighCoef[j]*rayleigh + mieCoef[j]*mie) * math.Exp(-e)
+				if s.Earthshine {
+					ev := rayleighCoef[j]*viewRayleigh + mieCoef[j]*viewMie + ozoneCoef[j]*viewOzone
+					cur[j] += coefficientAt(ground, l) * (rayleighCoef[j]*dRayleigh + mieCoef[j]*dMie) * math.Exp(-ev)
+				}
+			}
+		}
+
+		if i > 0 {
+			for j := range cur {
+				out.Values[j] += (prev[j] + cur[j]) * dx / 2
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return out
+}
+
+// Whether the view ray transmittance is below the cutoff in every channel, given the
+// smallest extinction of any channel
+func (s *Scene) pastCutoff(minExtinction float64) bool {
+	if s.TransmittanceCutoff > 0 && math.Exp(-minExtinction) < s.TransmittanceCutoff {
+		s.skippedSamples.Add(1)
+		return true
+	}
+	return false
+}
+
+// Number of in-scattering samples left out by TransmittanceCutoff so far
+func (s *Scene) SkippedSamples() int64 {
+	return s.skippedSamples.Load()
+}
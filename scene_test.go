@@ -0,0 +1,1014 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSceneCheck(t *testing.T) {
+	if errs := NewScene(nil).Check(); len(errs) != 0 {
+		t.Fatalf("Expected default scene to be valid, got %v", errs)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(s *Scene)
+		want   string
+	}{
+		{"size", func(s *Scene) { s.Height = 0 }, "image size"},
+		{"inner radius", func(s *Scene) { s.Planet.Radius = -1 }, "planet radius"},
+		{"outer radius", func(s *Scene) { s.Atmosphere.Radius = EarthRadius / 2 }, "atmosphere radius"},
+		{"center", func(s *Scene) { s.Atmosphere.Transform = Translate(Vector3{1, 0, 0}) }, "atmosphere center"},
+		{"rigid", func(s *Scene) { s.Planet.Transform = s.Planet.Transform.Mul(Scale(Vector3{1, 1.01, 1})) }, "planet transform"},
+		{"camera", func(s *Scene) { s.Camera.Position = Vector3{0, 0, EarthRadius / 2} }, "below the planet surface"},
+		{"look at", func(s *Scene) { s.Camera.LookAt = s.Camera.Position }, "look at"},
+		{"fov", func(s *Scene) { s.Camera.FOVDegrees = 180 }, "field of view"},
+		{"sun direction", func(s *Scene) { s.Sun.Direction = Vector3{3, -5, 1} }, "not normalized"},
+		{"sun intensity", func(s *Scene) { s.Sun.Intensity = -1 }, "sunlight intensity"},
+		{"rayleigh", func(s *Scene) { RayleighExtinction.G = -1 }, "rayleigh extinction"},
+		{"mie", func(s *Scene) { MieExtinction.B = -1 }, "mie extinction"},
+		{"ozone", func(s *Scene) { OzoneAbsorption.R = -1 }, "ozone absorption"},
+		{"ozone width", func(s *Scene) { OzoneWidth = 0 }, "ozone layer width"},
+		{"density scale", func(s *Scene) { RayleighDensityScale = 0 }, "rayleigh density scale"},
+		{"mie density scale", func(s *Scene) { MieDensityScale = -1 }, "mie density scale"},
+		{"step", func(s *Scene) { MaxIntegrationStep = -1 }, "max integration distance"},
+		{"multi scatter", func(s *Scene) { MultiScatterFactor = 1 }, "multiple scattering factor"},
+		{"gamma", func(s *Scene) { s.Gamma = 0 }, "gamma"},
+		{"frames", func(s *Scene) { s.Frames = 0 }, "frame count"},
+		{"samples", func(s *Scene) { s.SunSamples = 1 }, "sun samples"},
+		{"denoise", func(s *Scene) { s.Denoise = -1 }, "denoise radius"},
+		{"cutoff", func(s *Scene) { s.TransmittanceCutoff = 1 }, "transmittance cutoff"},
+		{"wavelengths", func(s *Scene) { s.Wavelengths = []float64{650, 0} }, "wavelength"},
+		{"depth table", func(s *Scene) { s.DepthTableAngles = 1 }, "optical depth table"},
+	}
+	for _, tt := range tests {
+		rayleigh, mie, scale, step := RayleighExtinction, MieExtinction, RayleighDensityScale, MaxIntegrationStep
+		ozone, ozoneWidth, mieScale, multi := OzoneAbsorption, OzoneWidth, MieDensityScale, MultiScatterFactor
+
+		s := NewScene(nil)
+		tt.modify(s)
+		errs := s.Check()
+
+		RayleighExtinction, MieExtinction, RayleighDensityScale, MaxIntegrationStep = rayleigh, mie, scale, step
+		OzoneAbsorption, OzoneWidth, MieDensityScale, MultiScatterFactor = ozone, ozoneWidth, mieScale, multi
+
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.want) {
+			t.Errorf("%s: expected a single error containing %q, got %v", tt.name, tt.want, errs)
+		}
+	}
+}
+
+func TestSceneRender(t *testing.T) {
+	scene := NewScene(testTexture())
+	scene.Width, scene.Height = 64, 48
+	scene.Threads = 2
+	img := scene.Render()
+
+	if want := image.Rect(0, 0, 64, 48); img.Bounds() != want {
+		t.Fatalf("Expected bounds %v got %v", want, img.Bounds())
+	}
+	// The planet fills the center of the view and space is black in the corner
+	if c := img.RGBAAt(32, 20); c.R == 0 && c.G == 0 && c.B == 0 {
+		t.Errorf("Expected lit planet at the center, got %v", c)
+	}
+	if c := img.RGBAAt(0, 0); c != (color.RGBA{0, 0, 0, 255}) {
+		t.Errorf("Expected black space in the corner, got %v", c)
+	}
+}
+
+func TestSceneRenderNoTexture(t *testing.T) {
+	scene := NewScene(nil)
+	scene.Width, scene.Height = 64, 48
+	img := scene.Render()
+
+	// The lit planet is drawn in the missing texture color
+	if c := img.RGBAAt(32, 20); c.R == 0 || c.B == 0 || c.G >= c.R {
+		t.Errorf("Expected lit planet in the missing texture color, got %v", c)
+	}
+}
+
+func TestSceneNightTexture(t *testing.T) {
+	scene := NewScene(testTexture())
+	night := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			night.Set(x, y, color.NRGBA{255, 200, 100, 255})
+		}
+	}
+	toSun := scene.Sun.Direction.Multiply(-1)
+	hit := Hit{scene.Planet, 0}
+
+	day := toSun.Multiply(EarthRadius)
+	lit := scene.shadeSurface(hit, day, scene.Sun.Direction)
+	scene.NightTexture = night
+	if got := scene.shadeSurface(hit, day, scene.Sun.Direction); got != lit {
+		t.Errorf("Expected no night contribution on the day side, got %v instead of %v", got, lit)
+	}
+
+	dark := toSun.Multiply(-EarthRadius)
+	want := NewColorFromRGBA(night.At(0, 0).RGBA())
+	if got := scene.shadeSurface(hit, dark, toSun); !nearlyEqual(got.R, want.R, 1e-12) ||
+		!nearlyEqual(got.G, want.G, 1e-12) || !nearlyEqual(got.B, want.B, 1e-12) {
+		t.Errorf("Expected the full night texel %v on the night side, got %v", want, got)
+	}
+
+	// Smooth across the terminator
+	if w := nightWeight(0); w != 0 {
+		t.Errorf("Expected no night contribution at the terminator, got %v", w)
+	}
+	if w := nightWeight(-NightBlendWidth / 2); w <= 0 || w >= 1 {
+		t.Errorf("Expected partial night contribution in the blend band, got %v", w)
+	}
+}
+
+func TestSceneNormalMap(t *testing.T) {
+	scene := NewScene(testTexture())
+	solid := func(c color.Color) image.Image {
+		img := image.NewNRGBA64(image.Rect(0, 0, 4, 2))
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 4; x++ {
+				img.Set(x, y, c)
+			}
+		}
+		return img
+	}
+	// Partly lit point so the shading depends on the normal
+	toSun := scene.Sun.Direction.Multiply(-1)
+	cp := toSun.Add(toSun.Cross(Vector3{0, 1, 0}).Normalize()).Normalize().Multiply(EarthRadius)
+	hit := Hit{scene.Planet, 0}
+	want := scene.shadeSurface(hit, cp, cp.Multiply(-1).Normalize())
+
+	// A flat map points straight along the surface normal
+	scene.NormalMap = solid(color.NRGBA64{32768, 32768, 65535, 65535})
+	got := scene.shadeSurface(hit, cp, cp.Multiply(-1).Normalize())
+	if !got.ToVector3().NearlyEqual(want.ToVector3(), 1e-9) {
+		t.Errorf("Expected a flat normal map to leave the shading at %v, got %v", want, got)
+	}
+
+	scene.NormalMap = solid(color.NRGBA64{65535, 32768, 49152, 65535})
+	if got := scene.shadeSurface(hit, cp, cp.Multiply(-1).Normalize()); got.ToVector3().NearlyEqual(want.ToVector3(), 1e-3) {
+		t.Errorf("Expected a tilted normal map to change the shading from %v", want)
+	}
+}
+
+func TestSceneAmbient(t *testing.T) {
+	scene := NewScene(testTexture())
+	toSun := scene.Sun.Direction.Multiply(-1)
+	hit := Hit{scene.Planet, 0}
+	day, night := toSun.Multiply(EarthRadius), toSun.Multiply(-EarthRadius)
+
+	lit, dark := scene.shadeSurface(hit, day, scene.Sun.Direction), scene.shadeSurface(hit, night, toSun)
+	scene.Ambient = 2
+	if got := scene.shadeSurface(hit, day, scene.Sun.Direction); got != lit {
+		t.Errorf("Expected ambient to leave the day side unchanged, got %v instead of %v", got, lit)
+	}
+	got := scene.shadeSurface(hit, night, toSun)
+	want := dark.AddRGB(AmbientSky.MultiplyRGB(2))
+	if got != want {
+		t.Errorf("Expected ambient to raise the night side to %v, got %v", want, got)
+	}
+}
+
+func TestSceneRenderSize(t *testing.T) {
+	scene := NewScene(testTexture())
+	scene.Width, scene.Height = 100, 50
+	img := scene.Render()
+
+	if want := image.Rect(0, 0, 100, 50); img.Bounds() != want {
+		t.Fatalf("Expected bounds %v got %v", want, img.Bounds())
+	}
+	if c := img.RGBAAt(50, 25); c.R == 0 && c.G == 0 && c.B == 0 {
+		t.Errorf("Expected lit planet at the center, got %v", c)
+	}
+}
+
+func TestSceneCameraInsidePlanet(t *testing.T) {
+	scene := NewScene(testTexture())
+	scene.Width, scene.Height = 16, 12
+	scene.Camera.Position = scene.Planet.Center().Add(Vector3{0, 0, -EarthRadius / 2})
+	if errs := scene.Check(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "below the planet surface") {
+		t.Errorf("Expected Check to reject the camera, got %v", errs)
+	}
+
+	// Rendering anyway finishes with the same finite colors every time
+	finite := func(c Color) bool {
+		for _, v := range []float64{c.R, c.G, c.B, c.A} {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, p := range [][2]int{{8, 6}, {0, 0}, {15, 11}} {
+		c := scene.renderPixel(p[0], p[1])
+		if !finite(c) {
+			t.Errorf("Pixel %v: expected a finite color, got %v", p, c)
+		}
+		if again := scene.renderPixel(p[0], p[1]); again != c {
+			t.Errorf("Pixel %v: expected %v again, got %v", p, c, again)
+		}
+	}
+	for i, c := range scene.RenderHDR() {
+		if !finite(c) {
+			t.Fatalf("Pixel %d: expected a finite color, got %v", i, c)
+		}
+	}
+}
+
+func TestSceneSunDisk(t *testing.T) {
+	scene := NewScene(testTexture())
+	cam := scene.Camera.Position
+	disk := func(center Vector3) *Disk {
+		return &Disk{Center: center, N: cam.Sub(center).Normalize(), Radius: EarthRadius / 10, Transform: Identity()}
+	}
+
+	// Sun off to the side of the planet, seen through empty space
+	beside := Vector3{3 * EarthRadius, 0, 0}
+	scene.SunDisk = disk(beside)
+	c := scene.shadeRay(Ray{cam, beside.Sub(cam).Normalize()}, nil)
+	if want := scene.Sun.Intensity; c.R != want || c.G != want || c.B != want {
+		t.Errorf("Expected the sun intensity %v, got %v", want, c)
+	}
+
+	// Sun seen through the atmosphere is reddened
+	grazing := Vector3{EarthRadius + 20000, 0, 5 * EarthRadius}
+	scene.SunDisk = disk(grazing)
+	c = scene.shadeRay(Ray{cam, grazing.Sub(cam).Normalize()}, nil)
+	if !(c.B < c.R && c.R < scene.Sun.Intensity) {
+		t.Errorf("Expected the sun seen through the atmosphere to be attenuated, got %v", c)
+	}
+
+	// Sun hidden behind the planet
+	behind := Vector3{0, 0, 5 * EarthRadius}
+	scene.SunDisk = disk(behind)
+	c = scene.shadeRay(Ray{cam, behind.Sub(cam).Normalize()}, nil)
+	if c.R >= 1 {
+		t.Errorf("Expected the sun behind the planet to be hidden, got %v", c)
+	}
+
+	// Sun hidden behind another shape
+	scene.SunDisk = disk(beside)
+	scene.Shapes = []Shape{Sphere{cam.Lerp(beside, 0.5), EarthRadius / 5, Identity()}}
+	c = scene.shadeRay(Ray{cam, beside.Sub(cam).Normalize()}, nil)
+	if want := scene.Sun.Intensity; c.R == want && c.G == want && c.B == want {
+		t.Errorf("Expected the sun behind a shape to be hidden, got %v", c)
+	}
+}
+
+func TestNewSunDisk(t *testing.T) {
+	scene := NewScene(testTexture())
+	scene.SunDisk = NewSunDisk(scene.Planet.Center(), scene.Sun.Direction)
+	cam := scene.Camera.Position
+	toSun := scene.Sun.Direction.Multiply(-1)
+
+	// Seen at the sun direction from the camera as well as from the planet
+	if h := scene.SunDisk.Intersect(Ray{cam, toSun}); h == NoHit {
+		t.Fatalf("Expected the disk towards the sun")
+	}
+	// and subtending the sun angular radius
+	perp := toSun.Cross(Vector3{0, 1, 0}).Normalize()
+	for _, tt := range []struct {
+		angle float64
+		hit   bool
+	}{{0.9 * SunAngularRadius, true}, {1.1 * SunAngularRadius, false}} {
+		d := toSun.RotateAround(perp, tt.angle)
+		if got := scene.SunDisk.Intersect(Ray{scene.Planet.Center(), d}) != NoHit; got != tt.hit {
+			t.Errorf("Angle %v: expected hit %v, got %v", tt.angle, tt.hit, got)
+		}
+	}
+}
+
+func TestSceneBackground(t *testing.T) {
+	scene := NewScene(testTexture())
+	cam := scene.Camera.Position
+
+	// Looking away from the planet, directionUV maps -Z to u 0.25 and v 0.5
+	r := Ray{cam, Vector3{0, 0, -1}}
+	if got, want := scene.shadeRay(r, nil), (Color{0, 0, 0, 1}); got != want {
+		t.Errorf("Expected black without a background, got %v", got)
+	}
+
+	bg := image.NewRGBA(image.Rect(0, 0, 8, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 8; x++ {
+			bg.Set(x, y, color.NRGBA{uint8(x * 30), uint8(y * 60), 50, 255})
+		}
+	}
+	scene.Background = bg
+	if got, want := scene.shadeRay(r, nil), NewColorFromRGBA(bg.At(2, 2).RGBA()); got != want {
+		t.Errorf("Expected background texel %v got %v", want, got)
+	}
+
+	// The planet hides the background
+	toCenter := Ray{cam, scene.Planet.Center().Sub(cam).Normalize()}
+	scene.Background = nil
+	planet := scene.shadeRay(toCenter, nil)
+	scene.Background = bg
+	if got := scene.shadeRay(toCenter, nil); got != planet {
+		t.Errorf("Expected the planet %v in front of the background, got %v", planet, got)
+	}
+}
+
+func TestSceneShapes(t *testing.T) {
+	scene := NewScene(testTexture())
+	cam := scene.Camera.Position
+	toCenter := Ray{cam, scene.Planet.Center().Sub(cam).Normalize()}
+	planet := scene.shadeRay(toCenter, nil)
+
+	// Sphere between the camera and the atmosphere hides the planet and is not
+	// affected by scattering
+	front := Sphere{Vector3{0, 0, -20 * 1000 * 1000}, 1000 * 1000, Identity()}
+	scene.Shapes = []Shape{front}
+	cp := Vector3{0, 0, -21 * 1000 * 1000}
+	if got, want := scene.shadeRay(toCenter, nil), scene.shadeSurface(Hit{front, 0}, cp, toCenter.Direction); got != want {
+		t.Errorf("Expected shape in front of the atmosphere to be shaded %v, got %v", want, got)
+	}
+
+	// Sphere resting inside the atmosphere in front of the planet is shaded with
+	// the shape albedo and scattering
+	inside := Sphere{Vector3{0, 0, -EarthRadius - 20000}, 10000, Identity()}
+	scene.Shapes = []Shape{inside}
+	if got := scene.shadeRay(toCenter, nil); got == planet {
+		t.Errorf("Expected shape inside the atmosphere to hide the planet")
+	}
+	ShapeAlbedo = Color{0, 0, 0, 1}
+	dark := scene.shadeRay(toCenter, nil)
+	ShapeAlbedo = Color{0.5, 0.5, 0.5, 1}
+	if dark.R <= 0 || dark.B <= 0 {
+		t.Errorf("Expected in-scattered light in front of a black shape, got %v", dark)
+	}
+}
+
+func TestSunlightTwilight(t *testing.T) {
+	scene := NewScene(nil)
+
+	// Direction 3 degrees past the terminator on the night side
+	toSun := scene.Sun.Direction.Multiply(-1)
+	perp := toSun.Cross(Vector3{0, 1, 0}).Normalize()
+	a := 3 * math.Pi / 180
+	n := perp.Multiply(math.Cos(a)).Sub(toSun.Multiply(math.Sin(a)))
+
+	if _, lit := scene.sunlightAt(n.Multiply(EarthRadius+1000), scene.Sun.Direction); lit {
+		t.Errorf("Expected low altitude sample past the terminator to be dark")
+	}
+	high, lit := scene.sunlightAt(n.Multiply(EarthRadius+50000), scene.Sun.Direction)
+	if !lit {
+		t.Fatalf("Expected high altitude sample past the terminator to be lit")
+	}
+	// Sunlight reaching it has been attenuated by the atmosphere, blue the most
+	full, _ := scene.sunlightAt(toSun.Multiply(EarthRadius+50000), scene.Sun.Direction)
+	if high.X >= full.X || high.Z >= full.Z || high.Z/full.Z >= high.X/full.X {
+		t.Errorf("Expected attenuated twilight sunlight %v compared to overhead %v", high, full)
+	}
+}
+
+func TestSunlightSurfaceAcne(t *testing.T) {
+	scene := NewScene(nil)
+	toSun := scene.Sun.Direction.Multiply(-1)
+
+	// Points on and just above the lit surface must not shadow themselves. Rounding
+	// leaves many of them a fraction of a ULP inside the planet.
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		n := Vector3{rng.Float64()*2 - 1, rng.Float64()*2 - 1, rng.Float64()*2 - 1}.Normalize()
+		if n.Dot(toSun) < 0.05 {
+			continue
+		}
+		for _, h := range []float64{0, 1e-9} {
+			if _, lit := scene.sunlightAt(n.Multiply(EarthRadius+h), scene.Sun.Direction); !lit {
+				t.Fatalf("Expected lit surface point %v at %vm to be in sunlight", n, h)
+			}
+		}
+	}
+}
+
+func TestSunlightSoftShadow(t *testing.T) {
+	scene := NewScene(nil)
+	toSun := scene.Sun.Direction.Multiply(-1)
+
+	// Point on the night side whose ray to the sun center grazes the planet
+	perp := toSun.Cross(Vector3{0, 1, 0}).Normalize()
+	p := perp.Multiply(EarthRadius).Sub(toSun.Multiply(1e6))
+
+	radius := SunAngularRadius
+	defer func() { SunAngularRadius = radius }()
+
+	// A point sun gives the same answer for every sample
+	SunAngularRadius = 0
+	want, wantLit := scene.sunlightAt(p, scene.Sun.Direction)
+	sampler := NewSampler(0, 0, 0)
+	for i := 0; i < 100; i++ {
+		if got, lit := scene.sunlightAt(p, scene.sunDirection(sampler)); got != want || lit != wantLit {
+			t.Fatalf("Expected hard shadow %v %v got %v %v", want, wantLit, got, lit)
+		}
+	}
+
+	// Part of the sun disk is hidden behind the planet
+	SunAngularRadius = radius
+	var lit, dark int
+	for i := 0; i < 100; i++ {
+		if _, ok := scene.sunlightAt(p, scene.sunDirection(sampler)); ok {
+			lit++
+		} else {
+			dark++
+		}
+	}
+	if lit == 0 || dark == 0 {
+		t.Errorf("Expected a mix of lit and shadowed samples, got %v lit and %v dark", lit, dark)
+	}
+}
+
+func TestInScatterAcrossSun(t *testing.T) {
+	scene := NewScene(nil)
+	toSun := scene.Sun.Direction.Multiply(-1)
+
+	// Camera behind the planet looking towards the sun through the atmosphere 30km
+	// above the limb, the view rays sweep across the sun
+	perp := toSun.Cross(Vector3{0, 1, 0}).Normalize()
+	up := perp.Cross(toSun)
+	cam := toSun.Multiply(-3 * EarthRadius).Add(perp.Multiply(EarthRadius + 30000))
+
+	const n = 16
+	for _, a := range []float64{-0.01, -0.002, 0, 0.002, 0.01} {
+		r := Ray{cam, toSun.Add(up.Multiply(a)).Normalize()}
+		point := scene.shadeRay(r, nil)
+		var disk Color
+		for i := 0; i < n; i++ {
+			disk = disk.AddRGB(scene.shadeRay(r, NewSampler(i, 0, 0)).MultiplyRGB(1.0 / n))
+		}
+		if point.R < 0.01 {
+			t.Fatalf("a=%v: expected in-scattered light, got %v", a, point)
+		}
+		// Sampling the sun direction for every sample moves the phase angle and the
+		// shadow boundary by up to the sun radius, the radiance changes by ~1%
+		if disk.ToVector3() == point.ToVector3() {
+			t.Errorf("a=%v: expected the sun disk to change the radiance %v", a, point)
+		}
+		if !nearlyEqual(disk.R, point.R, 0.03) || !nearlyEqual(disk.G, point.G, 0.03) || !nearlyEqual(disk.B, point.B, 0.03) {
+			t.Errorf("a=%v: expected radiance %v close to the point sun %v", a, disk, point)
+		}
+	}
+}
+
+func TestViewTransmittanceTerminator(t *testing.T) {
+	scene := NewScene(nil)
+	so, si := scene.Atmosphere, scene.Planet
+
+	// View ray from the default camera to a surface point on the terminator
+	toSun := scene.Sun.Direction.Multiply(-1)
+	target := toSun.Cross(Vector3{0, 1, 0}).Normalize().Multiply(EarthRadius)
+	r := Ray{scene.Camera.Position, target.Sub(scene.Camera.Position).Normalize()}
+	ri := advanceRay(r, so.Intersect(r).T)
+	hi := si.Intersect(ri)
+	if hi == NoHit {
+		t.Fatalf("Expected ray to hit the planet")
+	}
+
+	got := scene.viewTransmittance(ri, hi.T, 50)
+	want := Color{0.8031964941, 0.6934728257, 0.5113178917, 1}
+	if !nearlyEqual(got.R, want.R, 1e-8) || !nearlyEqual(got.G, want.G, 1e-8) ||
+		!nearlyEqual(got.B, want.B, 1e-8) || got.A != want.A {
+		t.Errorf("Expected %v got %v", want, got)
+	}
+	// Blue is scattered out the most
+	if !(got.B < got.G && got.G < got.R && got.R < 1) {
+		t.Errorf("Expected transmittance to decrease with wavelength, got %v", got)
+	}
+}
+
+func TestOzoneZenith(t *testing.T) {
+	scene := NewScene(nil)
+	so := scene.Atmosphere
+
+	// Looking straight up from the surface
+	r := Ray{Vector3{0, EarthRadius, 0}, Vector3{0, 1, 0}}
+	length := so.Intersect(r).T
+
+	with := scene.viewTransmittance(r, length, 50)
+	ozone := OzoneAbsorption
+	OzoneAbsorption = Color{}
+	without := scene.viewTransmittance(r, length, 50)
+	OzoneAbsorption = ozone
+
+	if with.G/with.B >= 0.99*without.G/without.B {
+		t.Errorf("Expected ozone to reduce green relative to blue, got %v with and %v without", with, without)
+	}
+}
+
+func TestDensityFalloff(t *testing.T) {
+	if rayleighDensity(0) != 1 || mieDensity(0) != 1 {
+		t.Errorf("Expected unit densities at the surface, got %v and %v", rayleighDensity(0), mieDensity(0))
+	}
+	// Aerosols thin out faster than air molecules
+	for _, h := range []float64{0.05, 0.2, 0.5, 1} {
+		if mie, rayleigh := mieDensity(h), rayleighDensity(h); !(mie < rayleigh) {
+			t.Errorf("h=%v: expected Mie density %v below Rayleigh density %v", h, mie, rayleigh)
+		}
+	}
+}
+
+func TestSceneSampleCounts(t *testing.T) {
+	step := MaxIntegrationStep
+	MaxIntegrationStep = 0
+	defer func() { MaxIntegrationStep = step }()
+
+	scene := NewScene(testTexture())
+	cam := scene.Camera.Position
+	// Ray towards the lit limb of the planet
+	limb := scene.Sun.Direction.Multiply(-1).Cross(Vector3{0, 1, 0}).Normalize().Multiply(-EarthRadius * 0.9)
+	r := Ray{cam, limb.Sub(cam).Normalize()}
+	shade := func(view, sun int) Color {
+		scene.ViewSamples, scene.SunSamples = view, sun
+		return scene.shadeRay(r, nil)
+	}
+	diff := func(a, b Color) float64 {
+		return math.Abs(a.R-b.R) + math.Abs(a.G-b.G) + math.Abs(a.B-b.B)
+	}
+
+	ref := shade(2000, 200)
+	if low, high := diff(shade(5, 5), ref), diff(shade(50, 5), ref); high >= low {
+		t.Errorf("Expected more view samples to be closer to the reference, got %v and %v", low, high)
+	}
+	if low, high := diff(shade(2000, 2), ref), diff(shade(2000, 20), ref); high >= low {
+		t.Errorf("Expected more sun samples to be closer to the reference, got %v and %v", low, high)
+	}
+}
+
+func TestInScatterReference(t *testing.T) {
+	scene := NewScene(nil)
+	scene.ViewSamples = 400
+
+	// Factor 0 leaves single scattering, which is what the reference integrates
+	multi := MultiScatterFactor
+	MultiScatterFactor = 0
+	defer func() { MultiScatterFactor = multi }()
+	so, si := scene.Atmosphere, scene.Planet
+
+	// View ray passing 30km above the lit limb of the planet
+	cam := scene.Camera.Position
+	sinA := (EarthRadius + 30000) / cam.Length()
+	r := Ray{cam, Vector3{-sinA, 0, math.Sqrt(1 - sinA*sinA)}}
+	ri := advanceRay(r, so.Intersect(r).T)
+	if si.Intersect(ri) != NoHit {
+		t.Fatalf("Expected ray to miss the planet")
+	}
+	length := so.Intersect(ri).T
+	got := scene.shadeRay(r, nil)
+
+	// Integrate the single scattering equation directly, computing the view path
+	// transmittance to every sample from scratch
+	cosT := r.Direction.Dot(scene.Sun.Direction)
+	want := numIntegrateV(func(t, _ float64) Vector3 {
+		p := ri.At(t)
+		sun, lit := scene.sunlightAt(p, scene.Sun.Direction)
+		if !lit {
+			return Vector3{}
+		}
+		view := scene.extinction(ri, t, 200)
+		h := si.Altitude(p) / (so.Radius - si.Radius)
+		rayleigh := rayleighDensity(h) * 3 / (16 * math.Pi) * (1 + cosT*cosT)
+		mie := mieDensity(h) * miePhase(-cosT, MieG)
+		return Vector3{
+			sun.X * (RayleighExtinction.R*rayleigh + MieExtinction.R*mie) * math.Exp(-view.X),
+			sun.Y * (RayleighExtinction.G*rayleigh + MieExtinction.G*mie) * math.Exp(-view.Y),
+			sun.Z * (RayleighExtinction.B*rayleigh + MieExtinction.B*mie) * math.Exp(-view.Z),
+		}
+	}, 0, length, 2000)
+
+	if want.X < 0.01 {
+		t.Fatalf("Expected a visible amount of in-scattered light, got %v", want)
+	}
+	if !nearlyEqual(got.R, want.X, 0.01) || !nearlyEqual(got.G, want.Y, 0.01) || !nearlyEqual(got.B, want.Z, 0.01) {
+		t.Errorf("Expected in-scattering %v got %v", want, got)
+	}
+}
+
+func TestMultiScatterHorizon(t *testing.T) {
+	scene := NewScene(nil)
+	multi := MultiScatterFactor
+	defer func() { MultiScatterFactor = multi }()
+
+	// View ray just above the lit horizon
+	cam := scene.Camera.Position
+	sinA := (EarthRadius + 5000) / cam.Length()
+	r := Ray{cam, Vector3{-sinA, 0, math.Sqrt(1 - sinA*sinA)}}
+
+	MultiScatterFactor = 0
+	single := scene.shadeRay(r, nil)
+	prev := single
+	for _, f := range []float64{0.1, 0.3, 0.5, 0.8} {
+		MultiScatterFactor = f
+		got := scene.shadeRay(r, nil)
+		if !(got.R > prev.R && got.G > prev.G && got.B > prev.B) {
+			t.Errorf("f=%v: expected %v to be brighter than %v", f, got, prev)
+		}
+		if want := single.B / (1 - f); !nearlyEqual(got.B, want, 1e-12) {
+			t.Errorf("f=%v: expected blue %v got %v", f, want, got.B)
+		}
+		prev = got
+	}
+}
+
+func TestInScatterSpectrumRGB(t *testing.T) {
+	scene := NewScene(nil)
+	so, si := scene.Atmosphere, scene.Planet
+	multi := MultiScatterFactor
+	MultiScatterFactor = 0
+	defer func() { MultiScatterFactor = multi }()
+
+	// View ray passing 30km above the lit limb of the planet, nothing but the
+	// in-scattered light reaches the camera
+	cam := scene.Camera.Position
+	sinA := (EarthRadius + 30000) / cam.Length()
+	r := Ray{cam, Vector3{-sinA, 0, math.Sqrt(1 - sinA*sinA)}}
+	ri := advanceRay(r, so.Intersect(r).T)
+	if si.Intersect(ri) != NoHit {
+		t.Fatalf("Expected ray to miss the planet")
+	}
+	length := so.Intersect(ri).T
+	want := scene.shadeRay(r, nil)
+
+	// Sampling the spectrum at the RGB wavelengths reproduces the RGB integral
+	steps := integrationSteps(length, scene.ViewSamples, MaxIntegrationStep)
+	got := scene.inScatterSpectrum(ri, length, steps, nil, []float64{RedWavelength, GreenWavelength, BlueWavelength})
+	for i, w := range []float64{want.R, want.G, want.B} {
+		if !nearlyEqual(got.Values[i], w, 1e-3) {
+			t.Errorf("%vnm: expected %v got %v", got.Wavelengths[i], w, got.Values[i])
+		}
+	}
+
+	// A full spectral render of the same ray is still a blue sky
+	scene.Wavelengths = UniformWavelengths(16)
+	if c := scene.shadeRay(r, nil); !(c.B > c.R) {
+		t.Errorf("Expected a blue sky from the spectral render, got %v", c)
+	}
+}
+
+func TestEarthshine(t *testing.T) {
+	solid := func(c color.Color) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+		img.Set(0, 0, c)
+		return img
+	}
+	white, black := NewScene(solid(color.White)), NewScene(solid(color.Black))
+
+	// View ray passing 2km above the lit limb, through the low atmosphere
+	cam := white.Camera.Position
+	sinA := (EarthRadius + 2000) / cam.Length()
+	r := Ray{cam, Vector3{-sinA, 0, math.Sqrt(1 - sinA*sinA)}}
+
+	if w, b := white.shadeRay(r, nil), black.shadeRay(r, nil); w != b {
+		t.Errorf("Expected the surface to have no effect without earthshine, got %v and %v", w, b)
+	}
+	white.Earthshine, black.Earthshine = true, true
+	w, b := white.shadeRay(r, nil), black.shadeRay(r, nil)
+	if !(w.R > b.R*1.01 && w.G > b.G*1.01 && w.B > b.B*1.01) {
+		t.Errorf("Expected the sky over a white surface %v to be brighter than over a black one %v", w, b)
+	}
+
+	// The spectral path picks up the same light
+	white.Wavelengths, black.Wavelengths = UniformWavelengths(8), UniformWavelengths(8)
+	if w, b := white.shadeRay(r, nil), black.shadeRay(r, nil); !(w.G > b.G*1.01) {
+		t.Errorf("Expected the spectral sky over a white surface %v to be brighter than over a black one %v", w, b)
+	}
+}
+
+func TestIntegrationStepsGrazingRay(t *testing.T) {
+	scene := NewScene(nil)
+	so, si := scene.Atmosphere, scene.Planet
+
+	// Ray that skims 5km above the surface, entering and leaving the atmosphere
+	r := Ray{Vector3{-2 * EarthRadius, EarthRadius + 5000, 0}, Vector3{1, 0, 0}}
+	entry := so.Intersect(r)
+	if entry == NoHit || si.Intersect(r) != NoHit {
+		t.Fatalf("Expected ray to graze the atmosphere without hitting the planet")
+	}
+	ri := Ray{r.At(entry.T + 1), r.Direction}
+	length := so.Intersect(ri).T
+
+	fn := func(t, _ float64) float64 {
+		return scene.atmosphereDensity(ri.At(t))
+	}
+	ref := numIntegrate(fn, 0, length, 200000)
+
+	n := integrationSteps(length, 50, 20000)
+	if n <= 50 {
+		t.Fatalf("Expected more than 50 samples for a %vm path, got %v", length, n)
+	}
+	uncappedErr := math.Abs(numIntegrate(fn, 0, length, 50) - ref)
+	cappedErr := math.Abs(numIntegrate(fn, 0, length, n) - ref)
+	if cappedErr >= uncappedErr {
+		t.Errorf("Expected capped error %v to be less than uncapped error %v", cappedErr, uncappedErr)
+	}
+
+	if n := integrationSteps(1000, 50, 20000); n != 50 {
+		t.Errorf("Expected short paths to keep 50 samples, got %v", n)
+	}
+	if n := integrationSteps(length, 50, 0); n != 50 {
+		t.Errorf("Expected no limit to keep 50 samples, got %v", n)
+	}
+}
+
+func TestRenderImageThreads(t *testing.T) {
+	// Every pixel is shaded exactly once whatever the number of workers
+	for _, threads := range []int{0, 1, 3, 16} {
+		var mu sync.Mutex
+		counts := map[image.Point]int{}
+		img := image.NewRGBA(image.Rect(5, 7, 25, 20))
+		renderImage(img, threads, func(x, y int) Color {
+			mu.Lock()
+			counts[image.Point{x, y}]++
+			mu.Unlock()
+			return Color{0, 0, 0, 1}
+		})
+		if len(counts) != 20*13 {
+			t.Errorf("threads %v: expected %v pixels shaded, got %v", threads, 20*13, len(counts))
+		}
+		for p, n := range counts {
+			if n != 1 {
+				t.Errorf("threads %v: pixel %v shaded %v times", threads, p, n)
+			}
+		}
+	}
+}
+
+func TestRenderTilesCoverage(t *testing.T) {
+	// Every pixel is covered exactly once, including by tiles that don't divide the
+	// bounds evenly
+	bounds := image.Rect(5, 7, 25, 20)
+	for _, size := range []int{0, 1, 3, 7, 13, 32} {
+		var mu sync.Mutex
+		counts := map[image.Point]int{}
+		var calls, lastDone, lastTotal int
+		renderTiles(bounds, size, 3, func(r image.Rectangle) {
+			mu.Lock()
+			defer mu.Unlock()
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					counts[image.Point{x, y}]++
+				}
+			}
+		}, func(done, total int) {
+			calls++
+			if done != calls {
+				t.Errorf("size %v: expected progress %v got %v", size, calls, done)
+			}
+			lastDone, lastTotal = done, total
+		})
+
+		if len(counts) != 20*13 {
+			t.Errorf("size %v: expected %v pixels covered, got %v", size, 20*13, len(counts))
+		}
+		for p, n := range counts {
+			if !p.In(bounds) || n != 1 {
+				t.Errorf("size %v: pixel %v covered %v times", size, p, n)
+			}
+		}
+		if lastDone != lastTotal || lastTotal == 0 {
+			t.Errorf("size %v: expected progress to finish, got %v of %v", size, lastDone, lastTotal)
+		}
+	}
+}
+
+func TestRenderTiledMatchesRender(t *testing.T) {
+	scene := NewScene(testTexture())
+	scene.Width, scene.Height, scene.Frames = 40, 30, 2
+	want := scene.Render()
+
+	var last, total int
+	got := scene.RenderTiled(16, func(done, n int) { last, total = done, n })
+	if !bytes.Equal(got.Pix, want.Pix) {
+		t.Errorf("Expected tiled render to match the scanline render")
+	}
+	// 3x2 tiles for each of the 2 frames
+	if last != 12 || total != 12 {
+		t.Errorf("Expected progress 12 of 12, got %v of %v", last, total)
+	}
+}
+
+func TestRenderImageMatchesSerial(t *testing.T) {
+	scene := NewScene(testTexture())
+	shade := scene.renderPixel
+
+	// Window straddling the planet limb
+	bounds := image.Rect(110, 220, 150, 240)
+	serial := image.NewRGBA(bounds)
+	renderImage(serial, 1, shade)
+	parallel := image.NewRGBA(bounds)
+	renderImage(parallel, 4, shade)
+
+	if !bytes.Equal(serial.Pix, parallel.Pix) {
+		t.Errorf("Expected parallel render to match serial render")
+	}
+}
+
+// Small checkerboard standing in for the earth texture
+func testTexture() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			if (x+y)%2 == 0 {
+				img.Set(x, y, color.NRGBA{200, 180, 120, 255})
+			} else {
+				img.Set(x, y, color.NRGBA{20, 40, 120, 255})
+			}
+		}
+	}
+	return img
+}
+
+func TestSceneAAFlatRegion(t *testing.T) {
+	scene := NewScene(testTexture())
+	scene.Width, scene.Height = 64, 48
+
+	// Empty space is flat black whatever the number of samples
+	bounds := image.Rect(0, 0, 64, 3)
+	want := image.NewRGBA(bounds)
+	renderImage(want, 1, scene.renderPixel)
+	for _, aa := range []int{2, 3} {
+		scene.AA = aa
+		got := image.NewRGBA(bounds)
+		renderImage(got, 1, scene.renderPixel)
+		if !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("AA %v: expected flat region to match a single sample render", aa)
+		}
+	}
+}
+
+func TestSceneAAEdgeVariance(t *testing.T) {
+	scene := NewScene(testTexture())
+	scene.Width, scene.Height = 64, 48
+
+	// Pixel on the left limb of the planet, variance of the pixel estimate over
+	// different jitter sequences
+	variance := func(aa int) float64 {
+		scene.AA = aa
+		var sum, sum2 float64
+		const trials = 30
+		for i := 0; i < trials; i++ {
+			c := scene.supersample(12, 24, NewSampler(12, 24, i))
+			l := c.R + c.G + c.B
+			sum += l
+			sum2 += l * l
+		}
+		mean := sum / trials
+		return sum2/trials - mean*mean
+	}
+
+	v2, v4 := variance(2), variance(4)
+	if v2 == 0 {
+		t.Fatalf("Expected pixel to straddle the limb and vary with jitter")
+	}
+	if v4 >= v2 {
+		t.Errorf("Expected variance to decrease with more samples, got %v for 2x2 and %v for 4x4", v2, v4)
+	}
+
+	// The same pixel always renders the same
+	scene.AA = 4
+	if a, b := scene.renderPixel(12, 24), scene.renderPixel(12, 24); a != b {
+		t.Errorf("Expected deterministic jitter, got %v and %v", a, b)
+	}
+}
+
+func TestAccumulateStable(t *testing.T) {
+	frame := []Color{{0.1, 0.2, 0.3, 1}, {1.5, 0, 7, 1}, {1.0 / 3, 2.0 / 3, 0.999, 0.5}}
+	acc := make([]Color, len(frame))
+	for n := 0; n < 16; n++ {
+		accumulate(acc, frame, n)
+	}
+	for i := range frame {
+		if acc[i] != frame[i] {
+			t.Errorf("Expected average of identical frames to be %v, got %v", frame[i], acc[i])
+		}
+	}
+
+	// Distinct frames average
+	acc = make([]Color, 1)
+	for n, c := range []Color{{1, 0, 0, 1}, {0, 1, 0, 1}, {0, 0, 1, 1}, {1, 1, 1, 1}} {
+		accumulate(acc, []Color{c}, n)
+	}
+	if want := (Color{0.5, 0.5, 0.5, 1}); acc[0] != want {
+		t.Errorf("Expected %v got %v", want, acc[0])
+	}
+}
+
+func TestSceneFrames(t *testing.T) {
+	scene := NewScene(testTexture())
+	scene.Width, scene.Height = 32, 24
+
+	// Without AA every frame is identical so the average matches a single frame
+	single := scene.RenderHDR()
+	scene.Frames = 3
+	if multi := scene.RenderHDR(); !colorsEqual(single, multi) {
+		t.Errorf("Expected averaging identical frames to match a single frame")
+	}
+
+	// With AA each frame uses a different jitter
+	scene.AA = 2
+	scene.Frames = 1
+	single = scene.RenderHDR()
+	scene.Frames = 4
+	if multi := scene.RenderHDR(); colorsEqual(single, multi) {
+		t.Errorf("Expected frames with different jitter to change the average")
+	}
+}
+
+func colorsEqual(a, b []Color) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSkyOnlyHorizonRedderThanZenith(t *testing.T) {
+	scene := NewSkyScene()
+	if errs := scene.Check(); len(errs) > 0 {
+		t.Fatalf("Expected a valid sky scene, got %v", errs)
+	}
+
+	const width, height = 64, 64
+	ratio := func(y int) float64 {
+		c := scene.shadeRay(scene.Camera.RayFor(width/2, y, width, height), nil)
+		if c.R <= 0 || c.B <= 0 {
+			t.Fatalf("Expected light from the sky at row %d, got %v", y, c)
+		}
+		return c.B / c.R
+	}
+
+	horizon, zenith := ratio(height-1), ratio(0)
+	if !(horizon < zenith) {
+		t.Errorf("Expected the horizon B/R %v to be below the zenith B/R %v", horizon, zenith)
+	}
+}
+
+func TestTransmittanceCutoff(t *testing.T) {
+	// A cutoff of 0 integrates the whole path
+	full := NewScene(nil)
+	full.Width, full.Height = 32, 24
+	cut := NewScene(nil)
+	cut.Width, cut.Height = 32, 24
+	cut.TransmittanceCutoff = 0
+	want, got := full.RenderHDR(), cut.RenderHDR()
+	for i := range want {
+		if want[i] != got[i] {
+			t.Fatalf("Expected cutoff 0 to match the full render at pixel %d, got %v instead of %v", i, got[i], want[i])
+		}
+	}
+
+	// View ray passing 500m above the lit limb, most of the long path through the
+	// low atmosphere is hidden behind the air in front of it
+	cam := full.Camera.Position
+	sinA := (EarthRadius + 500) / cam.Length()
+	r := Ray{cam, Vector3{-sinA, 0, math.Sqrt(1 - sinA*sinA)}}
+	cut.TransmittanceCutoff = 0.01
+
+	fc, cc := full.shadeRay(r, nil), cut.shadeRay(r, nil)
+	for _, ch := range [][2]float64{{fc.R, cc.R}, {fc.G, cc.G}, {fc.B, cc.B}} {
+		if math.Abs(ch[0]-ch[1]) > 0.05*ch[0] {
+			t.Errorf("Expected the cutoff %v to stay within 5%% of the full path %v", cc, fc)
+			break
+		}
+	}
+
+	// The skipped samples do not trace sun rays, which is where the time goes
+	if n := full.SkippedSamples(); n != 0 {
+		t.Errorf("Expected no samples skipped without a cutoff, got %v", n)
+	}
+	if n := cut.SkippedSamples(); n < int64(cut.ViewSamples)/4 {
+		t.Errorf("Expected at least a quarter of the %v view samples to be skipped, got %v", cut.ViewSamples, n)
+	}
+}
+
+func TestSunDepthsShadowSkipsIntegration(t *testing.T) {
+	scene := NewScene(nil)
+	center := scene.Planet.Center()
+	toSun := scene.Sun.Direction.Multiply(-1)
+
+	// Behind the planet the sun ray points straight at its center
+	p := center.Sub(toSun.Multiply(EarthRadius + 10000))
+	if _, _, _, lit := scene.sunDepths(p, scene.Sun.Direction); lit {
+		t.Fatalf("Expected %v to be in shadow", p)
+	}
+	if n := scene.sunRays.Load(); n != 0 {
+		t.Errorf("Expected the shadow to be found before integrating the sun ray, %v were integrated", n)
+	}
+
+	p = center.Add(toSun.Multiply(EarthRadius + 10000))
+	if _, _, _, lit := scene.sunDepths(p, scene.Sun.Direction); !lit {
+		t.Fatalf("Expected %v to be lit", p)
+	}
+	if n := scene.sunRays.Load(); n != 1 {
+		t.Errorf("Expected the lit point to integrate one sun ray, got %v", n)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// Colors used by the slice view for the regions outside the atmosphere
+var (
+	SlicePlanetColor = Color{0, 0, 0.3, 1}
+	SliceSpaceColor  = Color{0, 0, 0, 1}
+)
+
+// Quantity drawn by the slice view
+type SliceField int
+
+const (
+	// Atmosphere density, dimmed in the planet's shadow
+	SliceDensity SliceField = iota
+	// Sunlight scattered at each point, in any direction, relative to the
+	// unattenuated sunlight scattered at sea level
+	SliceInScatter
+)
+
+func parseSliceField(s string) (SliceField, error) {
+	switch s {
+	case "density":
+		return SliceDensity, nil
+	case "inscatter":
+		return SliceInScatter, nil
+	}
+	return SliceDensity, fmt.Errorf("unknown slice field %q, expected density or inscatter", s)
+}
+
+// Returns the 2D basis of the slice plane. u points towards the sun and v is
+// perpendicular to it, both pass through the planet center.
+func (s *Scene) sliceBasis() (u, v Vector3) {
+	u = s.Sun.Direction.Multiply(-1)
+	up := Vector3{0, 1, 0}
+	if math.Abs(u.Dot(up)) > 0.9 {
+		up = Vector3{1, 0, 0}
+	}
+	v = u.Cross(up).Cross(u).Normalize()
+	return u, v
+}
+
+// Heatmap color of the field at world space position p. For the density, points in
+// the shadow of the planet are drawn darker so that the terminator is visible. The
+// in-scattered light is zero in the shadow.
+func (s *Scene) sliceSample(p Vector3, field SliceField) Color {
+	if s.Planet.Contains(p) {
+		return SlicePlanetColor
+	}
+	if !s.Atmosphere.Contains(p) {
+		return SliceSpaceColor
+	}
+
+	var d float64
+	switch field {
+	case SliceInScatter:
+		d = s.sliceInScatter(p)
+	default:
+		d = s.atmosphereDensity(p)
+		toSun := s.Sun.Direction.Multiply(-1)
+		if s.Planet.Occludes(Ray{p.Add(toSun.Multiply(ShadowRayEpsilon)), toSun}) {
+			d *= 0.25
+		}
+	}
+
+	// Black -> red -> yellow -> white
+	return Color{clamp(3*d, 0, 1), clamp(3*d-1, 0, 1), clamp(3*d-2, 0, 1), 1}
+}
+
+// Sunlight reaching p scaled by the Rayleigh and Mie scattering coefficients there,
+// without the phase functions, summed over the channels. It is relative to the
+// same sum for unattenuated sunlight at sea level, so it stays within [0,1].
+func (s *Scene) sliceInScatter(p Vector3) float64 {
+	sun, lit := s.sunlightAt(p, s.Sun.Direction)
+	if !lit {
+		return 0
+	}
+	h := s.relativeAltitude(p)
+	dRayleigh, dMie := rayleighDensity(h), mieDensity(h)
+	scattered := sun.X*(RayleighExtinction.R*dRayleigh+MieExtinction.R*dMie) +
+		sun.Y*(RayleighExtinction.G*dRayleigh+MieExtinction.G*dMie) +
+		sun.Z*(RayleighExtinction.B*dRayleigh+MieExtinction.B*dMie)
+	ref := s.Sun.Intensity * (RayleighExtinction.R + RayleighExtinction.G + RayleighExtinction.B +
+		MieExtinction.R + MieExtinction.G + MieExtinction.B)
+	return scattered / ref
+}
+
+// Renders a top-down cross-section of the field through the planet and atmosphere in
+// the plane containing the sun direction. The sun is to the right of the image.
+func (s *Scene) RenderSlice(field SliceField) *image.RGBA {
+	width, height := s.Width, s.Height
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	center := s.Atmosphere.Center()
+	u, v := s.sliceBasis()
+
+	// Fit the outer atmosphere vertically with a small border
+	scale := 1.05 * s.Atmosphere.Radius / float64(height/2)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			a := float64(x-width/2) * scale
+			b := float64(height/2-y) * scale
+			p := center.Add(u.Multiply(a)).Add(v.Multiply(b))
+			img.Set(x, y, s.sliceSample(p, field).Pack())
+		}
+	}
+
+	return img
+}
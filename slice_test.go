@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestSliceDensityFalloff(t *testing.T) {
+	scene := NewScene(nil)
+
+	// Walk outwards along the lit radial line pointing at the sun
+	u, _ := scene.sliceBasis()
+	prev := Color{2, 2, 2, 1}
+	for h := 0.0; h < EarthAtmosphereHeight; h += EarthAtmosphereHeight / 20 {
+		c := scene.sliceSample(u.Multiply(EarthRadius+h+1), SliceDensity)
+		if c.R+c.G+c.B >= prev.R+prev.G+prev.B {
+			t.Errorf("Expected heatmap to decrease with altitude at %vm, got %v after %v", h, c, prev)
+		}
+		prev = c
+	}
+
+	if c := scene.sliceSample(Vector3{0, 0, 0}, SliceDensity); c != SlicePlanetColor {
+		t.Errorf("Expected planet color at the center, got %v", c)
+	}
+	if c := scene.sliceSample(u.Multiply(2*EarthRadius), SliceDensity); c != SliceSpaceColor {
+		t.Errorf("Expected space color outside the atmosphere, got %v", c)
+	}
+}
+
+func TestSliceInScatter(t *testing.T) {
+	scene := NewScene(nil)
+	u, _ := scene.sliceBasis()
+
+	// Lit low in the atmosphere on the sun side, dark in the planet's shadow
+	lit := scene.sliceInScatter(u.Multiply(EarthRadius + 2000))
+	if lit <= 0 || lit > 1 {
+		t.Errorf("Expected in-scattering in (0,1] on the lit side, got %v", lit)
+	}
+	if got := scene.sliceInScatter(u.Multiply(-(EarthRadius + 2000))); got != 0 {
+		t.Errorf("Expected no in-scattering in the shadow, got %v", got)
+	}
+	// Less air higher up scatters less
+	if high := scene.sliceInScatter(u.Multiply(EarthRadius + 40000)); high >= lit {
+		t.Errorf("Expected less in-scattering at 40km %v than at 2km %v", high, lit)
+	}
+
+	if c := scene.sliceSample(u.Multiply(EarthRadius+2000), SliceInScatter); c == scene.sliceSample(u.Multiply(EarthRadius+2000), SliceDensity) {
+		t.Errorf("Expected the in-scatter heatmap to differ from the density, got %v", c)
+	}
+	if _, err := parseSliceField("pressure"); err == nil {
+		t.Errorf("Expected an error for an unknown slice field")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import "math"
+
+// Wavelengths in nanometers of the R, G and B channels, the scattering coefficients
+// are given at these wavelengths
+const (
+	RedWavelength   = 650.0
+	GreenWavelength = 570.0
+	BlueWavelength  = 475.0
+)
+
+// Range of visible wavelengths in nanometers covered by UniformWavelengths
+const (
+	MinWavelength = 380.0
+	MaxWavelength = 780.0
+)
+
+// Light sampled at a set of wavelengths, Values[i] is the radiance at
+// Wavelengths[i] nanometers. Wavelengths are in increasing or decreasing order and
+// each value stands for the band halfway to its neighbours.
+type Spectrum struct {
+	Wavelengths []float64
+	Values      []float64
+}
+
+// Spectrum over the given wavelengths with every value set to v
+func NewSpectrum(wavelengths []float64, v float64) Spectrum {
+	s := Spectrum{wavelengths, make([]float64, len(wavelengths))}
+	for i := range s.Values {
+		s.Values[i] = v
+	}
+	return s
+}
+
+// Centers of n equal width bins spanning the visible range
+func UniformWavelengths(n int) []float64 {
+	w := make([]float64, n)
+	for i := range w {
+		w[i] = MinWavelength + (MaxWavelength-MinWavelength)*(float64(i)+0.5)/float64(n)
+	}
+	return w
+}
+
+// Width in nanometers of the band that sample i stands for, from halfway to the
+// previous wavelength to halfway to the next. The end samples are given the same
+// width on their outer side.
+func bandWidth(wavelengths []float64, i int) float64 {
+	n := len(wavelengths)
+	switch {
+	case n == 1:
+		return 1
+	case i == 0:
+		return math.Abs(wavelengths[1] - wavelengths[0])
+	case i == n-1:
+		return math.Abs(wavelengths[n-1] - wavelengths[n-2])
+	}
+	return math.Abs(wavelengths[i+1]-wavelengths[i-1]) / 2
+}
+
+// Convert to linear sRGB through the CIE 1931 color matching functions. The result
+// is white balanced for the wavelengths sampled so that a flat spectrum of value v
+// becomes the color {v, v, v}.
+func (s Spectrum) ToColor() Color {
+	var x, y, z, fx, fy, fz float64
+	for i, l := range s.Wavelengths {
+		cx, cy, cz := cieXYZ(l)
+		w := bandWidth(s.Wavelengths, i)
+		x += s.Values[i] * cx * w
+		y += s.Values[i] * cy * w
+		z += s.Values[i] * cz * w
+		fx += cx * w
+		fy += cy * w
+		fz += cz * w
+	}
+	if fx <= 0 || fy <= 0 || fz <= 0 {
+		return Color{0, 0, 0, 1}
+	}
+
+	// Scale XYZ so a flat spectrum lands on the D65 white point, the white of sRGB
+	x *= 0.95047 / fx
+	y *= 1 / fy
+	z *= 1.08883 / fz
+	return Color{
+		3.2404542*x - 1.5371385*y - 0.4985314*z,
+		-0.9692660*x + 1.8760108*y + 0.0415560*z,
+		0.0556434*x - 0.2040259*y + 1.0572252*z,
+		1,
+	}
+}
+
+// CIE 1931 2 degree color matching functions at wavelength l nanometers, using the
+// multi-lobe Gaussian fit from Wyman, Sloan and Shirley, "Simple Analytic
+// Approximations to the CIE XYZ Color Matching Functions"
+func cieXYZ(l float64) (float64, float64, float64) {
+	g := func(mu, s1, s2 float64) float64 {
+		s := s1
+		if l >= mu {
+			s = s2
+		}
+		t := (l - mu) / s
+		return math.Exp(-t * t / 2)
+	}
+	x := 1.056*g(599.8, 37.9, 31.0) + 0.362*g(442.0, 16.0, 26.7) - 0.065*g(501.1, 20.4, 26.2)
+	y := 0.821*g(568.8, 46.9, 40.5) + 0.286*g(530.9, 16.3, 31.1)
+	z := 1.217*g(437.0, 11.8, 36.0) + 0.681*g(459.0, 26.0, 13.8)
+	return x, y, z
+}
+
+// Value of the RGB coefficients c at wavelength l nanometers, linearly interpolated
+// between the channel wavelengths and held constant beyond them
+func coefficientAt(c Color, l float64) float64 {
+	switch {
+	case l <= BlueWavelength:
+		return c.B
+	case l <= GreenWavelength:
+		return c.B + (c.G-c.B)*(l-BlueWavelength)/(GreenWavelength-BlueWavelength)
+	case l <= RedWavelength:
+		return c.G + (c.R-c.G)*(l-GreenWavelength)/(RedWavelength-GreenWavelength)
+	}
+	return c.R
+}
+
+// Rayleigh extinction at wavelength l nanometers. Scattering by air molecules goes
+// as the inverse fourth power of the wavelength, which the RGB coefficients follow,
+// so it is scaled from the red coefficient.
+func rayleighExtinctionAt(l float64) float64 {
+	r := RedWavelength / l
+	return RayleighExtinction.R * r * r * r * r
+}
+
+// Mie extinction at wavelength l nanometers
+func mieExtinctionAt(l float64) float64 {
+	return coefficientAt(MieExtinction, l)
+}
+
+// Ozone absorption at wavelength l nanometers
+func ozoneAbsorptionAt(l float64) float64 {
+	return coefficientAt(OzoneAbsorption, l)
+}
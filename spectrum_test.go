@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSpectrumToColorWhite(t *testing.T) {
+	for _, n := range []int{3, 16, 40} {
+		got := NewSpectrum(UniformWavelengths(n), 2).ToColor()
+		if !nearlyEqual(got.R, 2, 1e-4) || !nearlyEqual(got.G, 2, 1e-4) || !nearlyEqual(got.B, 2, 1e-4) || got.A != 1 {
+			t.Errorf("n=%v: expected a flat spectrum to be white {2 2 2 1}, got %v", n, got)
+		}
+	}
+}
+
+func TestSpectrumToColorHue(t *testing.T) {
+	wavelengths := UniformWavelengths(40)
+	band := func(lo, hi float64) Color {
+		s := NewSpectrum(wavelengths, 0)
+		for i, l := range wavelengths {
+			if l >= lo && l < hi {
+				s.Values[i] = 1
+			}
+		}
+		return s.ToColor()
+	}
+	if c := band(620, 700); !(c.R > c.G && c.R > c.B) {
+		t.Errorf("Expected long wavelengths to be red, got %v", c)
+	}
+	if c := band(500, 560); !(c.G > c.R && c.G > c.B) {
+		t.Errorf("Expected middle wavelengths to be green, got %v", c)
+	}
+	if c := band(430, 480); !(c.B > c.R && c.B > c.G) {
+		t.Errorf("Expected short wavelengths to be blue, got %v", c)
+	}
+}
+
+func TestExtinctionAtRGBWavelengths(t *testing.T) {
+	for _, tt := range []struct {
+		l       float64
+		channel func(c Color) float64
+	}{
+		{RedWavelength, func(c Color) float64 { return c.R }},
+		{GreenWavelength, func(c Color) float64 { return c.G }},
+		{BlueWavelength, func(c Color) float64 { return c.B }},
+	} {
+		if got, want := rayleighExtinctionAt(tt.l), tt.channel(RayleighExtinction); !nearlyEqual(got, want, 1e-4) {
+			t.Errorf("%vnm: expected Rayleigh extinction %v got %v", tt.l, want, got)
+		}
+		if got, want := mieExtinctionAt(tt.l), tt.channel(MieExtinction); !nearlyEqual(got, want, 1e-12) {
+			t.Errorf("%vnm: expected Mie extinction %v got %v", tt.l, want, got)
+		}
+		if got, want := ozoneAbsorptionAt(tt.l), tt.channel(OzoneAbsorption); !nearlyEqual(got, want, 1e-12) {
+			t.Errorf("%vnm: expected ozone absorption %v got %v", tt.l, want, got)
+		}
+	}
+	// Shorter wavelengths scatter more
+	if rayleighExtinctionAt(400) <= rayleighExtinctionAt(700) || math.IsInf(rayleighExtinctionAt(380), 0) {
+		t.Errorf("Expected Rayleigh extinction to fall with wavelength")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import "math"
+
+// Triangle with vertices V0, V1 and V2. UV0, UV1 and UV2 are the texture coordinates
+// of the vertices in their X and Y components, when all three are zero the defaults
+// (0,0), (1,0) and (0,1) are used.
+type Triangle struct {
+	V0, V1, V2    Vector3
+	UV0, UV1, UV2 Vector3
+	Transform     Matrix
+}
+
+var _ Shape = &Triangle{}
+
+// Möller–Trumbore ray triangle intersection, both faces are hit
+func (tr Triangle) Intersect(r Ray) Hit {
+	m, ok := tr.Transform.TryInverse()
+	if !ok {
+		return NoHit
+	}
+	or := m.TransformRay(r)
+
+	e1, e2 := tr.V1.Sub(tr.V0), tr.V2.Sub(tr.V0)
+	p := or.Direction.Cross(e2)
+	det := e1.Dot(p)
+	if math.Abs(det) < 1e-12 {
+		// Ray is parallel to the triangle
+		return NoHit
+	}
+	inv := 1 / det
+
+	s := or.Origin.Sub(tr.V0)
+	u := s.Dot(p) * inv
+	if u < 0 || u > 1 {
+		return NoHit
+	}
+	q := s.Cross(e1)
+	v := or.Direction.Dot(q) * inv
+	if v < 0 || u+v > 1 {
+		return NoHit
+	}
+	if t := e2.Dot(q) * inv; t > 1e-5 {
+		return Hit{tr, t}
+	}
+	return NoHit
+}
+
+// Barycentric coordinates of a point in the plane of the triangle, the weights of
+// V1 and V2. The weight of V0 is 1-u-v.
+func (tr Triangle) barycentric(p Vector3) (u, v float64) {
+	e1, e2, ep := tr.V1.Sub(tr.V0), tr.V2.Sub(tr.V0), p.Sub(tr.V0)
+	d11, d12, d22 := e1.Dot(e1), e1.Dot(e2), e2.Dot(e2)
+	dp1, dp2 := ep.Dot(e1), ep.Dot(e2)
+	denom := d11*d22 - d12*d12
+	u = (d22*dp1 - d12*dp2) / denom
+	v = (d11*dp2 - d12*dp1) / denom
+	return u, v
+}
+
+// Interpolates the vertex UVs at the position
+func (tr Triangle) UV(wp Vector3) Vector3 {
+	p := tr.Transform.Inverse().MulPosition(wp)
+	u, v := tr.barycentric(p)
+
+	uv0, uv1, uv2 := tr.UV0, tr.UV1, tr.UV2
+	if uv0 == (Vector3{}) && uv1 == (Vector3{}) && uv2 == (Vector3{}) {
+		uv1, uv2 = Vector3{1, 0, 0}, Vector3{0, 1, 0}
+	}
+	return uv0.Multiply(1 - u - v).Add(uv1.Multiply(u)).Add(uv2.Multiply(v))
+}
+
+// Geometric face normal, the direction of (V1-V0) x (V2-V0). Like Sphere.Normal it
+// transforms by the inverse transpose to stay perpendicular under non-uniform scaling.
+func (tr Triangle) Normal(wp Vector3) Vector3 {
+	n := tr.V1.Sub(tr.V0).Cross(tr.V2.Sub(tr.V0))
+	return tr.Transform.Inverse().Transpose().MulDirection(n).Normalize()
+}
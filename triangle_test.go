@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestTriangleIntersect(t *testing.T) {
+	tr := Triangle{
+		V0: Vector3{-1, -1, 10}, V1: Vector3{1, -1, 10}, V2: Vector3{0, 1, 10},
+		UV0: Vector3{0, 0, 0}, UV1: Vector3{1, 0, 0}, UV2: Vector3{0.5, 1, 0},
+		Transform: Identity(),
+	}
+
+	// Through the centroid
+	centroid := tr.V0.Add(tr.V1).Add(tr.V2).Divide(3)
+	r := Ray{Vector3{centroid.X, centroid.Y, 0}, Vector3{0, 0, 1}}
+	h := tr.Intersect(r)
+	if h.Shape == nil || !nearlyEqual(h.T, 10, 1e-12) {
+		t.Fatalf("Expected hit at t=10, got %v", h)
+	}
+	want := Vector3{0.5, 1.0 / 3, 0}
+	if uv := tr.UV(r.At(h.T)); !uv.NearlyEqual(want, 1e-9) {
+		t.Errorf("Expected interpolated UV %v, got %v", want, uv)
+	}
+
+	// Just outside the V0-V1 edge
+	if h := tr.Intersect(Ray{Vector3{0, -1.01, 0}, Vector3{0, 0, 1}}); h != NoHit {
+		t.Errorf("Expected ray outside the edge to miss, got %v", h)
+	}
+
+	// From behind
+	h = tr.Intersect(Ray{Vector3{centroid.X, centroid.Y, 20}, Vector3{0, 0, -1}})
+	if h.Shape == nil || !nearlyEqual(h.T, 10, 1e-12) {
+		t.Errorf("Expected backface hit at t=10, got %v", h)
+	}
+
+	if n := tr.Normal(centroid); !n.NearlyEqual(Vector3{0, 0, 1}, 1e-12) {
+		t.Errorf("Expected face normal (0,0,1), got %v", n)
+	}
+}
+
+func TestTriangleDefaultUV(t *testing.T) {
+	tr := Triangle{V0: Vector3{0, 0, 0}, V1: Vector3{2, 0, 0}, V2: Vector3{0, 2, 0}, Transform: Translate(Vector3{0, 0, 5})}
+	if uv := tr.UV(Vector3{2, 0, 5}); !uv.NearlyEqual(Vector3{1, 0, 0}, 1e-12) {
+		t.Errorf("Expected default UV (1,0) at V1, got %v", uv)
+	}
+}
+
+func TestTriangleNormalScaled(t *testing.T) {
+	m := Translate(Vector3{1, 2, 3}).Mul(Scale(Vector3{2, 1, 1}))
+	tr := Triangle{V0: Vector3{0, 0, 0}, V1: Vector3{0, 0, 1}, V2: Vector3{1, -1, 0}, Transform: m}
+
+	// Face normal of the transformed vertices
+	w0, w1, w2 := m.MulPosition(tr.V0), m.MulPosition(tr.V1), m.MulPosition(tr.V2)
+	want := w1.Sub(w0).Cross(w2.Sub(w0)).Normalize()
+	if n := tr.Normal(w0); n.DistanceTo(want) > 1e-12 {
+		t.Errorf("Expected normal %v got %v", want, n)
+	}
+}
@@ -2,7 +2,11 @@
 
 package main
 
-import "math"
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
 
 type Vector3 struct {
 	X, Y, Z float64
@@ -33,6 +37,17 @@ func (v Vector3) Length() float64 {
 	return math.Sqrt(v.LengthSquared())
 }
 
+// Distance between the points v and v2
+func (v Vector3) DistanceTo(v2 Vector3) float64 {
+	return v.Sub(v2).Length()
+}
+
+// Squared distance between the points v and v2, cheaper than DistanceTo when only
+// comparing distances
+func (v Vector3) DistanceSquaredTo(v2 Vector3) float64 {
+	return v.Sub(v2).LengthSquared()
+}
+
 func (v Vector3) Normalize() Vector3 {
 	return v.Divide(v.Length())
 }
@@ -48,3 +63,98 @@ func (v Vector3) Cross(v2 Vector3) Vector3 {
 		(v.X * v2.Y) - (v.Y * v2.X),
 	}
 }
+
+// Returns true if each component is within relative epsilon of v2's, using the
+// same comparison as nearlyEqual. Like nearlyEqual a zero component only matches
+// zero or a value smaller than the smallest normal float.
+func (v Vector3) NearlyEqual(v2 Vector3, epsilon float64) bool {
+	return nearlyEqual(v.X, v2.X, epsilon) && nearlyEqual(v.Y, v2.Y, epsilon) && nearlyEqual(v.Z, v2.Z, epsilon)
+}
+
+// Component-wise minimum of v and v2
+func (v Vector3) Min(v2 Vector3) Vector3 {
+	return Vector3{math.Min(v.X, v2.X), math.Min(v.Y, v2.Y), math.Min(v.Z, v2.Z)}
+}
+
+// Component-wise maximum of v and v2
+func (v Vector3) Max(v2 Vector3) Vector3 {
+	return Vector3{math.Max(v.X, v2.X), math.Max(v.Y, v2.Y), math.Max(v.Z, v2.Z)}
+}
+
+// Component-wise absolute value
+func (v Vector3) Abs() Vector3 {
+	return Vector3{math.Abs(v.X), math.Abs(v.Y), math.Abs(v.Z)}
+}
+
+// Linearly interpolate from v to v2, t is not clamped so values outside [0,1] extrapolate
+func (v Vector3) Lerp(v2 Vector3, t float64) Vector3 {
+	return v.Add(v2.Sub(v).Multiply(t))
+}
+
+// Color with the components as RGB and alpha 1
+func (v Vector3) ToColor() Color {
+	return Color{v.X, v.Y, v.Z, 1}
+}
+
+// Component of v parallel to onto, which need not be unit length but must not be zero
+func (v Vector3) Project(onto Vector3) Vector3 {
+	return onto.Multiply(v.Dot(onto) / onto.LengthSquared())
+}
+
+// Component of v perpendicular to onto, v minus its projection
+func (v Vector3) Reject(onto Vector3) Vector3 {
+	return v.Sub(v.Project(onto))
+}
+
+// Reflect v about the normal. The normal must be unit length, the result is not normalized.
+func (v Vector3) Reflect(normal Vector3) Vector3 {
+	return v.Sub(normal.Multiply(2 * v.Dot(normal)))
+}
+
+// Rotate v by radians about axis with Rodrigues' rotation formula. The rotation is
+// counterclockwise looking back down the axis, the right hand rule. axis need not
+// be unit length but must not be zero.
+func (v Vector3) RotateAround(axis Vector3, radians float64) Vector3 {
+	k := axis.Normalize()
+	s, c := math.Sin(radians), math.Cos(radians)
+	return v.Multiply(c).Add(k.Cross(v).Multiply(s)).Add(k.Multiply(k.Dot(v) * (1 - c)))
+}
+
+// Returns n flipped if needed so that it faces against the ray direction dir, giving
+// the normal of the side of a surface that the ray hits
+func faceForward(n, dir Vector3) Vector3 {
+	if n.Dot(dir) > 0 {
+		return n.Multiply(-1)
+	}
+	return n
+}
+
+// Refract v through a surface with the given normal using Snell's law. v and normal
+// must be unit length and face each other, eta is the ratio of the indices of
+// refraction n1/n2. Returns true and the zero vector if total internal reflection
+// occurs instead.
+func (v Vector3) Refract(normal Vector3, eta float64) (Vector3, bool) {
+	cosI := -v.Dot(normal)
+	k := 1 - eta*eta*(1-cosI*cosI)
+	if k < 0 {
+		return Vector3{}, true
+	}
+	return v.Multiply(eta).Add(normal.Multiply(eta*cosI - math.Sqrt(k))), false
+}
+
+// Vectors are stored in JSON as a compact [x, y, z] array
+func (v Vector3) MarshalJSON() ([]byte, error) {
+	return json.Marshal([3]float64{v.X, v.Y, v.Z})
+}
+
+func (v *Vector3) UnmarshalJSON(data []byte) error {
+	var a []float64
+	if err := json.Unmarshal(data, &a); err != nil {
+		return err
+	}
+	if len(a) != 3 {
+		return fmt.Errorf("Vector3 needs 3 components, got %d", len(a))
+	}
+	v.X, v.Y, v.Z = a[0], a[1], a[2]
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestCross(t *testing.T) {
+	x := Vector3{1, 0, 0}
+	y := Vector3{0, 1, 0}
+	z := Vector3{0, 0, 1}
+
+	// Right handed basis
+	tests := []struct {
+		a, b, want Vector3
+	}{
+		{x, y, z},
+		{y, z, x},
+		{z, x, y},
+		{y, x, Vector3{0, 0, -1}},
+	}
+	for _, tt := range tests {
+		if got := tt.a.Cross(tt.b); got != tt.want {
+			t.Errorf("%v x %v = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	a := Vector3{1, -2, 3}
+	b := Vector3{-4, 5, 0.5}
+	if got := a.Cross(a); got != (Vector3{}) {
+		t.Errorf("Expected a x a to be zero, got %v", got)
+	}
+	if ab, ba := a.Cross(b), b.Cross(a); ab != ba.Multiply(-1) {
+		t.Errorf("Expected a x b = -(b x a), got %v and %v", ab, ba)
+	}
+}
+
+func TestReflect(t *testing.T) {
+	n := Vector3{0, 1, 0}
+	tests := []struct {
+		v, want Vector3
+	}{
+		{Vector3{1, -1, 0}, Vector3{1, 1, 0}},
+		// Parallel to the normal bounces straight back
+		{Vector3{0, -1, 0}, Vector3{0, 1, 0}},
+		// Grazing the surface is unaffected
+		{Vector3{1, 0, 0}, Vector3{1, 0, 0}},
+	}
+	for _, tt := range tests {
+		if got := tt.v.Reflect(n); got != tt.want {
+			t.Errorf("%v.Reflect(%v) = %v, want %v", tt.v, n, got, tt.want)
+		}
+	}
+}
+
+func TestMinMaxAbs(t *testing.T) {
+	a, b := Vector3{-1, 2, -3}, Vector3{4, -5, -6}
+	if got, want := a.Min(b), (Vector3{-1, -5, -6}); got != want {
+		t.Errorf("%v.Min(%v) = %v, want %v", a, b, got, want)
+	}
+	if got, want := a.Max(b), (Vector3{4, 2, -3}); got != want {
+		t.Errorf("%v.Max(%v) = %v, want %v", a, b, got, want)
+	}
+	if got, want := a.Abs(), (Vector3{1, 2, 3}); got != want {
+		t.Errorf("%v.Abs() = %v, want %v", a, got, want)
+	}
+}
+
+func TestDistanceTo(t *testing.T) {
+	a, b := Vector3{1, 2, 3}, Vector3{4, 6, 3}
+	if got := a.DistanceTo(b); got != 5 {
+		t.Errorf("%v.DistanceTo(%v) = %v, want 5", a, b, got)
+	}
+	if got := b.DistanceTo(a); got != 5 {
+		t.Errorf("%v.DistanceTo(%v) = %v, want 5", b, a, got)
+	}
+	if got := a.DistanceSquaredTo(b); got != 25 {
+		t.Errorf("%v.DistanceSquaredTo(%v) = %v, want 25", a, b, got)
+	}
+	if got := a.DistanceTo(a); got != 0 {
+		t.Errorf("%v.DistanceTo(%v) = %v, want 0", a, a, got)
+	}
+}
+
+func TestProjectReject(t *testing.T) {
+	v := Vector3{3, -4, 5}
+	if got, want := v.Project(Vector3{0, 2, 0}), (Vector3{0, -4, 0}); got != want {
+		t.Errorf("Expected projection %v got %v", want, got)
+	}
+	if got, want := v.Reject(Vector3{0, 2, 0}), (Vector3{3, 0, 5}); got != want {
+		t.Errorf("Expected rejection %v got %v", want, got)
+	}
+
+	for _, onto := range []Vector3{{1, 1, 0}, {-2, 0.5, 3}, SunlightDir} {
+		p, r := v.Project(onto), v.Reject(onto)
+		if got := p.Add(r); !got.NearlyEqual(v, 1e-12) {
+			t.Errorf("onto %v: expected project + reject to give %v, got %v", onto, v, got)
+		}
+		if d := r.Dot(onto); math.Abs(d) > 1e-12 {
+			t.Errorf("onto %v: expected perpendicular rejection %v, dot %v", onto, r, d)
+		}
+		if c := p.Cross(onto); c.Length() > 1e-12 {
+			t.Errorf("onto %v: expected parallel projection %v", onto, p)
+		}
+	}
+}
+
+func TestVector3RotateAround(t *testing.T) {
+	if got := (Vector3{1, 0, 0}).RotateAround(Vector3{0, 0, 1}, math.Pi/2); got.DistanceTo(Vector3{0, 1, 0}) > 1e-12 {
+		t.Errorf("Expected {0 1 0} got %v", got)
+	}
+
+	v, axis := Vector3{0.3, -1.2, 2}, Vector3{1, 2, -0.5}
+	if got := v.RotateAround(axis, 2*math.Pi); got.DistanceTo(v) > 1e-12 {
+		t.Errorf("Expected a full turn to return %v, got %v", v, got)
+	}
+	// Rotation keeps the length and the component along the axis
+	got := v.RotateAround(axis, 1)
+	if !nearlyEqual(got.Length(), v.Length(), 1e-12) || !nearlyEqual(got.Dot(axis), v.Dot(axis), 1e-12) {
+		t.Errorf("Expected %v to keep its length and axis component, got %v", v, got)
+	}
+}
+
+func TestVector3NearlyEqual(t *testing.T) {
+	tests := []struct {
+		a, b Vector3
+		want bool
+	}{
+		{Vector3{1, -2, 3}, Vector3{1, -2, 3}, true},
+		{Vector3{1, -2, 3}, Vector3{1 + 1e-12, -2, 3 - 1e-12}, true},
+		{Vector3{1, -2, 3}, Vector3{1, -2.001, 3}, false},
+		{Vector3{0, 1, 0}, Vector3{0, 1 + 1e-12, 0}, true},
+		// Relative comparison, any value is far from zero
+		{Vector3{0, 1, 0}, Vector3{1e-12, 1, 0}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.a.NearlyEqual(tt.b, 1e-9); got != tt.want {
+			t.Errorf("%v.NearlyEqual(%v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestLerp(t *testing.T) {
+	a, b := Vector3{1, 2, 3}, Vector3{3, 6, -1}
+	tests := []struct {
+		t    float64
+		want Vector3
+	}{
+		{0, a},
+		{1, b},
+		{0.5, Vector3{2, 4, 1}},
+		{2, Vector3{5, 10, -5}},
+	}
+	for _, tt := range tests {
+		if got := a.Lerp(b, tt.t); got != tt.want {
+			t.Errorf("%v.Lerp(%v, %v) = %v, want %v", a, b, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestRefract(t *testing.T) {
+	n := Vector3{0, 1, 0}
+
+	// Matching indices pass straight through
+	v := Vector3{1, -1, 0}.Normalize()
+	got, tir := v.Refract(n, 1)
+	if tir {
+		t.Fatalf("Unexpected total internal reflection for eta 1")
+	}
+	if !nearlyEqual(got.X, v.X, 1e-12) || !nearlyEqual(got.Y, v.Y, 1e-12) || got.Z != 0 {
+		t.Errorf("Expected %v got %v", v, got)
+	}
+
+	// Entering a denser medium bends towards the normal, sin(t) = eta * sin(i)
+	got, tir = v.Refract(n, 1/1.5)
+	if tir {
+		t.Fatalf("Unexpected total internal reflection entering a denser medium")
+	}
+	if !nearlyEqual(got.X, v.X/1.5, 1e-12) || !nearlyEqual(got.Length(), 1, 1e-12) {
+		t.Errorf("Expected refracted X %v with unit length, got %v", v.X/1.5, got)
+	}
+
+	// Leaving a dense medium at a grazing angle reflects
+	v = Vector3{1, -0.1, 0}.Normalize()
+	got, tir = v.Refract(n, 1.5)
+	if !tir || got != (Vector3{}) {
+		t.Errorf("Expected total internal reflection, got %v, %v", got, tir)
+	}
+}
+
+func TestVector3JSON(t *testing.T) {
+	v := Vector3{1.5, -2, 3e6}
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal failed %v", err)
+	}
+	if string(data) != "[1.5,-2,3000000]" {
+		t.Errorf("Expected array form, got %s", data)
+	}
+
+	var got Vector3
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal failed %v", err)
+	}
+	if got != v {
+		t.Errorf("Expected %v got %v", v, got)
+	}
+
+	for _, s := range []string{"[1,2]", "[1,2,3,4]", `{"X":1,"Y":2,"Z":3}`} {
+		if err := json.Unmarshal([]byte(s), &got); err == nil {
+			t.Errorf("Expected error unmarshaling %s", s)
+		}
+	}
+}